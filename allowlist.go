@@ -0,0 +1,110 @@
+package caddy_matchtoken
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// AllowlistConfig checks the token against a remote allowlist service, for
+// instance to honor revocations without reloading the config. The service
+// receives a GET request to URL with the token in the Authorization header,
+// as "Bearer <token>", and answers with a 2xx status for an accepted token
+// and 401, 403 or 404 for a rejected one. Any other status, or no answer
+// within Timeout, is an upstream failure.
+type AllowlistConfig struct {
+	// URL is the allowlist endpoint. Required.
+	URL string `json:"url,omitempty"`
+
+	// CacheTTL is how long an answer, accepted or rejected, is reused for the
+	// same token. Defaults to 1m. Upstream failures are not cached.
+	CacheTTL caddy.Duration `json:"cache_ttl,omitempty"`
+
+	// CacheSize bounds the number of cached answers; the least recently used
+	// one is evicted first. Defaults to 10000.
+	CacheSize int `json:"cache_size,omitempty"`
+
+	// Timeout bounds each request to the service. Defaults to 5s.
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	// FailOpen accepts the token when the service fails. By default it is
+	// rejected.
+	FailOpen bool `json:"fail_open,omitempty"`
+
+	client *http.Client
+	cache  *lruCache[bool]
+	logger *zap.Logger
+}
+
+func (a *AllowlistConfig) provision(logger *zap.Logger) error {
+	if a.URL == "" {
+		return fmt.Errorf("allowlist: url is required")
+	}
+	if u, err := url.Parse(a.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("allowlist: invalid url '%s'", a.URL)
+	}
+	if a.CacheTTL < 0 || a.Timeout < 0 || a.CacheSize < 0 {
+		return fmt.Errorf("allowlist: cache_ttl, cache_size and timeout must not be negative")
+	}
+	if a.CacheTTL == 0 {
+		a.CacheTTL = caddy.Duration(time.Minute)
+	}
+	if a.CacheSize == 0 {
+		a.CacheSize = 10000
+	}
+	if a.Timeout == 0 {
+		a.Timeout = caddy.Duration(5 * time.Second)
+	}
+	a.client = &http.Client{Timeout: time.Duration(a.Timeout)}
+	a.cache = newLRUCache[bool](a.CacheSize)
+	a.logger = logger
+	return nil
+}
+
+// allowed reports whether the service accepts token, using a cached answer
+// while it is fresh.
+func (a *AllowlistConfig) allowed(token string) bool {
+	key := sha256.Sum256([]byte(token))
+	now := time.Now()
+	if ok, found := a.cache.get(key, now); found {
+		return ok
+	}
+	ok, err := a.query(token)
+	if err != nil {
+		a.logger.Warn("allowlist query failed", zap.Bool("fail_open", a.FailOpen), zap.Error(err))
+		return a.FailOpen
+	}
+	a.cache.put(key, ok, now.Add(time.Duration(a.CacheTTL)))
+	return ok
+}
+
+func (a *AllowlistConfig) query(token string) (bool, error) {
+	req, err := http.NewRequest(http.MethodGet, a.URL, nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	// drain a little so the connection can be reused
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return true, nil
+	case resp.StatusCode == http.StatusUnauthorized,
+		resp.StatusCode == http.StatusForbidden,
+		resp.StatusCode == http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+}
@@ -0,0 +1,109 @@
+package caddy_matchtoken
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+// Header of a bloom filter file; see WriteBloomFilter for the format.
+const (
+	bloomMagic   = "MTBF"
+	bloomVersion = 1
+)
+
+// bloomFilter is a read-only bloom filter of tokens.
+type bloomFilter struct {
+	hashes int
+	bits   uint64
+	array  []byte
+}
+
+func loadBloomFilter(path string) (*bloomFilter, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, categorized(CategoryFile, fmt.Errorf("reading bloom filter file: %v", err))
+	}
+	if len(data) < 14 || string(data[:4]) != bloomMagic {
+		return nil, fmt.Errorf("bloom filter file %s: not a bloom filter", path)
+	}
+	if data[4] != bloomVersion {
+		return nil, fmt.Errorf("bloom filter file %s: unsupported version %d", path, data[4])
+	}
+	f := &bloomFilter{hashes: int(data[5]), bits: binary.BigEndian.Uint64(data[6:14]), array: data[14:]}
+	if f.hashes < 1 || f.hashes > 64 {
+		return nil, fmt.Errorf("bloom filter file %s: invalid hash count %d", path, f.hashes)
+	}
+	if f.bits == 0 || (f.bits+7)/8 != uint64(len(f.array)) {
+		return nil, fmt.Errorf("bloom filter file %s: size of %d bits does not match the %d bytes of data", path, f.bits, len(f.array))
+	}
+	return f, nil
+}
+
+// bloomPositions returns the two hashes the bit positions of token derive
+// from.
+func bloomPositions(token string) (uint64, uint64) {
+	sum := sha256.Sum256([]byte(token))
+	return binary.BigEndian.Uint64(sum[:8]), binary.BigEndian.Uint64(sum[8:16])
+}
+
+// mayContain reports whether token may be in the filter. False positives are
+// possible; false negatives are not.
+func (f *bloomFilter) mayContain(token string) bool {
+	h1, h2 := bloomPositions(token)
+	for i := 0; i < f.hashes; i++ {
+		bit := (h1 + uint64(i)*h2) % f.bits
+		if f.array[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// WriteBloomFilter writes a bloom filter of tokens to w, in the format read
+// for BloomFilterFile, sized so that about falsePositiveRate of the tokens
+// not in it still pass, such as 0.001 for one in a thousand. The file is laid
+// out as:
+//
+//	magic   4 bytes  "MTBF"
+//	version 1 byte   1
+//	hashes  1 byte   number of bit positions per token, k, from 1 to 64
+//	bits    8 bytes  size of the bit array, m, big-endian
+//	array   m/8 bytes, rounded up; bit i is bit i%8 of byte i/8
+//
+// The positions of a token are (h1 + i*h2) mod m for i in [0, k), where h1
+// and h2 are the first two big-endian uint64 of the SHA-256 of the token.
+func WriteBloomFilter(w io.Writer, tokens []string, falsePositiveRate float64) error {
+	if len(tokens) == 0 {
+		return errors.New("no tokens")
+	}
+	if !(falsePositiveRate > 0 && falsePositiveRate < 1) {
+		return fmt.Errorf("false positive rate must be between 0 and 1: %v", falsePositiveRate)
+	}
+	n := float64(len(tokens))
+	bits := uint64(math.Ceil(-n * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2)))
+	hashes := int(math.Round(float64(bits) / n * math.Ln2))
+	hashes = min(max(hashes, 1), 64)
+	f := &bloomFilter{hashes: hashes, bits: bits, array: make([]byte, (bits+7)/8)}
+	for _, token := range tokens {
+		h1, h2 := bloomPositions(token)
+		for i := 0; i < f.hashes; i++ {
+			bit := (h1 + uint64(i)*h2) % f.bits
+			f.array[bit/8] |= 1 << (bit % 8)
+		}
+	}
+	bw := bufio.NewWriter(w)
+	header := make([]byte, 14)
+	copy(header, bloomMagic)
+	header[4] = bloomVersion
+	header[5] = byte(f.hashes)
+	binary.BigEndian.PutUint64(header[6:], f.bits)
+	bw.Write(header)
+	bw.Write(f.array)
+	return bw.Flush()
+}
@@ -0,0 +1,97 @@
+package caddy_matchtoken
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+// lruCache is a size-bounded cache of values keyed by a SHA-256 hash, each
+// valid until its own deadline; the least recently used entry is evicted
+// first. It is safe for concurrent use.
+type lruCache[V any] struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List // front is the most recently used
+	entries map[[sha256.Size]byte]*list.Element
+	gen     uint64 // incremented by clear
+}
+
+type lruEntry[V any] struct {
+	key     [sha256.Size]byte
+	value   V
+	expires time.Time
+}
+
+func newLRUCache[V any](size int) *lruCache[V] {
+	return &lruCache[V]{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[[sha256.Size]byte]*list.Element, size),
+	}
+}
+
+func (c *lruCache[V]) get(key [sha256.Size]byte, now time.Time) (value V, found bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return value, false
+	}
+	entry := el.Value.(*lruEntry[V])
+	if now.After(entry.expires) {
+		c.order.Remove(el)
+		delete(c.entries, key)
+		return value, false
+	}
+	c.order.MoveToFront(el)
+	return entry.value, true
+}
+
+func (c *lruCache[V]) put(key [sha256.Size]byte, value V, expires time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.store(key, value, expires)
+}
+
+// generation returns a value that changes whenever the cache is cleared.
+func (c *lruCache[V]) generation() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.gen
+}
+
+// putAt is like put, but does nothing if the cache was cleared since gen was
+// obtained, so that a value computed from replaced data is not stored.
+func (c *lruCache[V]) putAt(gen uint64, key [sha256.Size]byte, value V, expires time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gen == c.gen {
+		c.store(key, value, expires)
+	}
+}
+
+func (c *lruCache[V]) store(key [sha256.Size]byte, value V, expires time.Time) {
+	if el, ok := c.entries[key]; ok {
+		entry := el.Value.(*lruEntry[V])
+		entry.value, entry.expires = value, expires
+		c.order.MoveToFront(el)
+		return
+	}
+	if c.order.Len() >= c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruEntry[V]).key)
+	}
+	c.entries[key] = c.order.PushFront(&lruEntry[V]{key: key, value: value, expires: expires})
+}
+
+// clear removes every entry.
+func (c *lruCache[V]) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.order.Init()
+	clear(c.entries)
+	c.gen++
+}
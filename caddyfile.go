@@ -0,0 +1,659 @@
+package caddy_matchtoken
+
+import (
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// UnmarshalCaddyfile sets up the matcher from Caddyfile tokens. Syntax:
+//
+//	matchToken [<prefix> [<hosts...>]] {
+//	    prefix       <prefixes...>
+//	    allow_empty_prefix
+//	    exclude_prefixes <prefixes...>
+//	    prefix_file  <path>
+//	    prefix_env   <pattern>
+//	    prefix_template <template>
+//	    host         <hosts...>
+//	    host_file    <path>
+//	    bypass_hosts <hosts...>
+//	    trusted_no_token_ranges <ranges...>
+//	    rule         <prefix> <hosts...>
+//	    host_prefix  <host> [<prefix>]
+//	    large_threshold <count>
+//	    host_mode    exact|suffix
+//	    exact_host_lookup binary|map|compact
+//	    dedupe_hosts
+//	    allow_empty_hosts
+//	    require_host_match true|false
+//	    match_any_host
+//	    match_host_with_port
+//	    trust_forwarded_host
+//	    use_tls_sni
+//	    case_sensitive_host
+//	    require_tls
+//	    min_proto_major <version>
+//	    time_windows <HH:MM-HH:MM...>
+//	    time_zone    <zone>
+//	    methods      <methods...>
+//	    header_match <name> <value>
+//	    case_insensitive_header_matches
+//	    query_match  <key> <value>
+//	    ports        <ports...>
+//	    path_prefixes <prefixes...>
+//	    remote_ranges <ranges...>
+//	    reload_interval <duration>
+//	    decision_cache_size <entries>
+//	    decision_cache_ttl <duration>
+//	    suffix       <suffix>
+//	    tokens       <tokens...>
+//	    tokens_mode  any|all
+//	    match_mode   prefix|suffix|contains|exact
+//	    prefix_separator <separator>
+//	    require_token_present
+//	    min_length   <bytes>
+//	    max_length   <bytes>
+//	    max_token_bytes <bytes>
+//	    header_name  <name>
+//	    header_names <names...>
+//	    sources      <sources...>
+//	    strict_single_source
+//	    split_header <separator>
+//	    cookie_name  <name>
+//	    cookie_names <names...>
+//	    query_param  <name>
+//	    path_token_index <index>
+//	    form_field   <name>
+//	    read_websocket_protocol [<prefix>]
+//	    read_basic_auth_password [<username>]
+//	    strip_bearer
+//	    trim_space
+//	    decode_base64
+//	    constant_time
+//	    case_insensitive_prefix
+//	    token_regex  <regexp>
+//	    hmac_secret  <secret>
+//	    hmac_algo    sha256|sha384|sha512
+//	    checksum_mode mod10|crc32
+//	    jwt {
+//	        secret   <secret>
+//	        jwks_url <url>
+//	        refresh_interval <duration>
+//	        claim    <name> <value>
+//	        leeway   <duration>
+//	    }
+//	    unverified_claim_match
+//	    unverified_audience <values...>
+//	    expiry {
+//	        separator <separator>
+//	        position  <index>
+//	        skew      <duration>
+//	    }
+//	    bloom_filter_file <path>
+//	    allowlist {
+//	        url        <url>
+//	        cache_ttl  <duration>
+//	        cache_size <entries>
+//	        timeout    <duration>
+//	        fail_open
+//	    }
+//	    negate
+//	    match_no_token
+//	    set_header_on_match <name>
+//	    metrics
+//	    log_rejected_hosts [<per_second>]
+//	}
+func (m *MatchToken) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	// iterate to merge multiple matchers into one
+	for d.Next() {
+		if d.NextArg() {
+			m.Prefix = append(m.Prefix, d.Val())
+			m.Host = append(m.Host, d.RemainingArgs()...)
+		}
+		for d.NextBlock(0) {
+			switch d.Val() {
+			case "prefix":
+				prefixes := d.RemainingArgs()
+				if len(prefixes) == 0 {
+					return d.ArgErr()
+				}
+				m.Prefix = append(m.Prefix, prefixes...)
+			case "allow_empty_prefix":
+				if err := parseFlag(d, &m.AllowEmptyPrefix); err != nil {
+					return err
+				}
+			case "exclude_prefixes":
+				prefixes := d.RemainingArgs()
+				if len(prefixes) == 0 {
+					return d.ArgErr()
+				}
+				m.ExcludePrefixes = append(m.ExcludePrefixes, prefixes...)
+			case "prefix_file":
+				if err := parseSingleArg(d, &m.PrefixFile); err != nil {
+					return err
+				}
+			case "bloom_filter_file":
+				if err := parseSingleArg(d, &m.BloomFilterFile); err != nil {
+					return err
+				}
+			case "prefix_env":
+				if err := parseSingleArg(d, &m.PrefixEnv); err != nil {
+					return err
+				}
+			case "prefix_template":
+				if err := parseSingleArg(d, &m.PrefixTemplate); err != nil {
+					return err
+				}
+			case "host":
+				hosts := d.RemainingArgs()
+				if len(hosts) == 0 {
+					return d.ArgErr()
+				}
+				m.Host = append(m.Host, hosts...)
+			case "require_tls":
+				if err := parseFlag(d, &m.RequireTLS); err != nil {
+					return err
+				}
+			case "min_proto_major":
+				if err := parseInt(d, &m.MinProtoMajor); err != nil {
+					return err
+				}
+			case "time_windows":
+				windows := d.RemainingArgs()
+				if len(windows) == 0 {
+					return d.ArgErr()
+				}
+				m.TimeWindows = append(m.TimeWindows, windows...)
+			case "time_zone":
+				if err := parseSingleArg(d, &m.TimeZone); err != nil {
+					return err
+				}
+			case "methods":
+				methods := d.RemainingArgs()
+				if len(methods) == 0 {
+					return d.ArgErr()
+				}
+				m.Methods = append(m.Methods, methods...)
+			case "header_match":
+				args := d.RemainingArgs()
+				if len(args) != 2 {
+					return d.ArgErr()
+				}
+				if m.HeaderMatches == nil {
+					m.HeaderMatches = make(map[string]string)
+				}
+				m.HeaderMatches[args[0]] = args[1]
+			case "query_match":
+				args := d.RemainingArgs()
+				if len(args) != 2 {
+					return d.ArgErr()
+				}
+				if m.QueryMatches == nil {
+					m.QueryMatches = make(map[string]string)
+				}
+				m.QueryMatches[args[0]] = args[1]
+			case "case_insensitive_header_matches":
+				if err := parseFlag(d, &m.CaseInsensitiveHeaderMatches); err != nil {
+					return err
+				}
+			case "ports":
+				ports := d.RemainingArgs()
+				if len(ports) == 0 {
+					return d.ArgErr()
+				}
+				m.Ports = append(m.Ports, ports...)
+			case "path_prefixes":
+				prefixes := d.RemainingArgs()
+				if len(prefixes) == 0 {
+					return d.ArgErr()
+				}
+				m.PathPrefixes = append(m.PathPrefixes, prefixes...)
+			case "remote_ranges":
+				ranges := d.RemainingArgs()
+				if len(ranges) == 0 {
+					return d.ArgErr()
+				}
+				m.RemoteRanges = append(m.RemoteRanges, ranges...)
+			case "large_threshold":
+				if err := parseInt(d, &m.LargeThreshold); err != nil {
+					return err
+				}
+			case "host_mode":
+				if err := parseSingleArg(d, &m.HostMode); err != nil {
+					return err
+				}
+			case "exact_host_lookup":
+				if err := parseSingleArg(d, &m.ExactHostLookup); err != nil {
+					return err
+				}
+			case "rule":
+				args := d.RemainingArgs()
+				if len(args) < 2 {
+					return d.ArgErr()
+				}
+				m.Rules = append(m.Rules, TokenRule{Prefix: args[0], Host: args[1:]})
+			case "host_prefix":
+				args := d.RemainingArgs()
+				if len(args) != 1 && len(args) != 2 {
+					return d.ArgErr()
+				}
+				hp := HostPrefix{Host: args[0]}
+				if len(args) == 2 {
+					hp.Prefix = args[1]
+				}
+				m.HostPrefixes = append(m.HostPrefixes, hp)
+			case "bypass_hosts":
+				hosts := d.RemainingArgs()
+				if len(hosts) == 0 {
+					return d.ArgErr()
+				}
+				m.BypassHosts = append(m.BypassHosts, hosts...)
+			case "trusted_no_token_ranges":
+				ranges := d.RemainingArgs()
+				if len(ranges) == 0 {
+					return d.ArgErr()
+				}
+				m.TrustedNoTokenRanges = append(m.TrustedNoTokenRanges, ranges...)
+			case "host_file":
+				if err := parseSingleArg(d, &m.HostFile); err != nil {
+					return err
+				}
+			case "dedupe_hosts":
+				if err := parseFlag(d, &m.DedupeHosts); err != nil {
+					return err
+				}
+			case "allow_empty_hosts":
+				if err := parseFlag(d, &m.AllowEmptyHosts); err != nil {
+					return err
+				}
+			case "require_host_match":
+				var val string
+				if err := parseSingleArg(d, &val); err != nil {
+					return err
+				}
+				require, err := strconv.ParseBool(val)
+				if err != nil {
+					return d.Errf("parsing require_host_match: %v", err)
+				}
+				m.RequireHostMatch = &require
+			case "match_any_host":
+				if err := parseFlag(d, &m.MatchAnyHost); err != nil {
+					return err
+				}
+			case "match_host_with_port":
+				if err := parseFlag(d, &m.MatchHostWithPort); err != nil {
+					return err
+				}
+			case "trust_forwarded_host":
+				if err := parseFlag(d, &m.TrustForwardedHost); err != nil {
+					return err
+				}
+			case "use_tls_sni":
+				if err := parseFlag(d, &m.UseTLSSNI); err != nil {
+					return err
+				}
+			case "case_sensitive_host":
+				if err := parseFlag(d, &m.CaseSensitiveHost); err != nil {
+					return err
+				}
+			case "reload_interval":
+				if err := parseDuration(d, &m.ReloadInterval); err != nil {
+					return err
+				}
+			case "decision_cache_size":
+				if err := parseInt(d, &m.DecisionCacheSize); err != nil {
+					return err
+				}
+			case "decision_cache_ttl":
+				if err := parseDuration(d, &m.DecisionCacheTTL); err != nil {
+					return err
+				}
+			case "suffix":
+				if err := parseSingleArg(d, &m.Suffix); err != nil {
+					return err
+				}
+			case "tokens":
+				tokens := d.RemainingArgs()
+				if len(tokens) == 0 {
+					return d.ArgErr()
+				}
+				m.Tokens = append(m.Tokens, tokens...)
+			case "tokens_mode":
+				if err := parseSingleArg(d, &m.TokensMode); err != nil {
+					return err
+				}
+			case "match_mode":
+				if err := parseSingleArg(d, &m.MatchMode); err != nil {
+					return err
+				}
+			case "prefix_separator":
+				if err := parseSingleArg(d, &m.RequireSeparatorAfterPrefix); err != nil {
+					return err
+				}
+			case "require_token_present":
+				if err := parseFlag(d, &m.RequireTokenPresent); err != nil {
+					return err
+				}
+			case "min_length":
+				if err := parseInt(d, &m.MinLength); err != nil {
+					return err
+				}
+			case "max_length":
+				if err := parseInt(d, &m.MaxLength); err != nil {
+					return err
+				}
+			case "max_token_bytes":
+				if err := parseInt(d, &m.MaxTokenBytes); err != nil {
+					return err
+				}
+			case "header_name":
+				if err := parseSingleArg(d, &m.HeaderName); err != nil {
+					return err
+				}
+			case "header_names":
+				names := d.RemainingArgs()
+				if len(names) == 0 {
+					return d.ArgErr()
+				}
+				m.HeaderNames = append(m.HeaderNames, names...)
+			case "sources":
+				sources := d.RemainingArgs()
+				if len(sources) == 0 {
+					return d.ArgErr()
+				}
+				m.Sources = append(m.Sources, sources...)
+			case "strict_single_source":
+				if err := parseFlag(d, &m.StrictSingleSource); err != nil {
+					return err
+				}
+			case "split_header":
+				if err := parseSingleArg(d, &m.SplitHeader); err != nil {
+					return err
+				}
+			case "cookie_name":
+				if err := parseSingleArg(d, &m.CookieName); err != nil {
+					return err
+				}
+			case "cookie_names":
+				names := d.RemainingArgs()
+				if len(names) == 0 {
+					return d.ArgErr()
+				}
+				m.CookieNames = append(m.CookieNames, names...)
+			case "query_param":
+				if err := parseSingleArg(d, &m.QueryParam); err != nil {
+					return err
+				}
+			case "path_token_index":
+				var index int
+				if err := parseInt(d, &index); err != nil {
+					return err
+				}
+				m.PathTokenIndex = &index
+			case "form_field":
+				if err := parseSingleArg(d, &m.FormField); err != nil {
+					return err
+				}
+			case "read_websocket_protocol":
+				m.ReadWebSocketProtocol = true
+				if d.NextArg() {
+					m.WebSocketProtocolPrefix = d.Val()
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "read_basic_auth_password":
+				m.ReadBasicAuthPassword = true
+				if d.NextArg() {
+					m.BasicAuthUsername = d.Val()
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "strip_bearer":
+				if err := parseFlag(d, &m.StripBearer); err != nil {
+					return err
+				}
+			case "trim_space":
+				if err := parseFlag(d, &m.TrimSpace); err != nil {
+					return err
+				}
+			case "decode_base64":
+				if err := parseFlag(d, &m.DecodeBase64); err != nil {
+					return err
+				}
+			case "constant_time":
+				if err := parseFlag(d, &m.ConstantTime); err != nil {
+					return err
+				}
+			case "case_insensitive_prefix":
+				if err := parseFlag(d, &m.CaseInsensitivePrefix); err != nil {
+					return err
+				}
+			case "token_regex":
+				if err := parseSingleArg(d, &m.TokenRegex); err != nil {
+					return err
+				}
+			case "hmac_secret":
+				if err := parseSingleArg(d, &m.HMACSecret); err != nil {
+					return err
+				}
+			case "hmac_algo":
+				if err := parseSingleArg(d, &m.HMACAlgo); err != nil {
+					return err
+				}
+			case "checksum_mode":
+				if err := parseSingleArg(d, &m.ChecksumMode); err != nil {
+					return err
+				}
+			case "jwt":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				m.JWT = new(JWTConfig)
+				if err := m.JWT.unmarshalCaddyfile(d); err != nil {
+					return err
+				}
+			case "unverified_claim_match":
+				if err := parseFlag(d, &m.UnverifiedClaimMatch); err != nil {
+					return err
+				}
+			case "unverified_audience":
+				values := d.RemainingArgs()
+				if len(values) == 0 {
+					return d.ArgErr()
+				}
+				m.UnverifiedAudience = append(m.UnverifiedAudience, values...)
+			case "expiry":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				m.Expiry = new(ExpiryConfig)
+				if err := m.Expiry.unmarshalCaddyfile(d); err != nil {
+					return err
+				}
+			case "allowlist":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				m.Allowlist = new(AllowlistConfig)
+				if err := m.Allowlist.unmarshalCaddyfile(d); err != nil {
+					return err
+				}
+			case "negate":
+				if err := parseFlag(d, &m.Negate); err != nil {
+					return err
+				}
+			case "match_no_token":
+				if err := parseFlag(d, &m.MatchNoToken); err != nil {
+					return err
+				}
+			case "set_header_on_match":
+				if err := parseSingleArg(d, &m.SetHeaderOnMatch); err != nil {
+					return err
+				}
+			case "metrics":
+				if err := parseFlag(d, &m.MetricsEnabled); err != nil {
+					return err
+				}
+			case "log_rejected_hosts":
+				m.LogRejectedHosts = true
+				if d.NextArg() {
+					rate, err := strconv.Atoi(d.Val())
+					if err != nil {
+						return d.Errf("parsing log_rejected_hosts: %v", err)
+					}
+					m.RejectedHostsLogRate = rate
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			default:
+				return d.Errf("unrecognized matchToken subdirective '%s'", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+// unmarshalCaddyfile parses the jwt block.
+func (j *JWTConfig) unmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "secret":
+			if err := parseSingleArg(d, &j.Secret); err != nil {
+				return err
+			}
+		case "jwks_url":
+			if err := parseSingleArg(d, &j.JWKSURL); err != nil {
+				return err
+			}
+		case "refresh_interval":
+			if err := parseDuration(d, &j.RefreshInterval); err != nil {
+				return err
+			}
+		case "claim":
+			args := d.RemainingArgs()
+			if len(args) != 2 {
+				return d.ArgErr()
+			}
+			j.Claim, j.Value = args[0], args[1]
+		case "leeway":
+			if err := parseDuration(d, &j.Leeway); err != nil {
+				return err
+			}
+		default:
+			return d.Errf("unrecognized jwt subdirective '%s'", d.Val())
+		}
+	}
+	return nil
+}
+
+// unmarshalCaddyfile parses the expiry block.
+func (e *ExpiryConfig) unmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "separator":
+			if err := parseSingleArg(d, &e.Separator); err != nil {
+				return err
+			}
+		case "position":
+			var pos int
+			if err := parseInt(d, &pos); err != nil {
+				return err
+			}
+			e.Position = &pos
+		case "skew":
+			if err := parseDuration(d, &e.Skew); err != nil {
+				return err
+			}
+		default:
+			return d.Errf("unrecognized expiry subdirective '%s'", d.Val())
+		}
+	}
+	return nil
+}
+
+// unmarshalCaddyfile parses the allowlist block.
+func (a *AllowlistConfig) unmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "url":
+			if err := parseSingleArg(d, &a.URL); err != nil {
+				return err
+			}
+		case "cache_ttl":
+			if err := parseDuration(d, &a.CacheTTL); err != nil {
+				return err
+			}
+		case "cache_size":
+			if err := parseInt(d, &a.CacheSize); err != nil {
+				return err
+			}
+		case "timeout":
+			if err := parseDuration(d, &a.Timeout); err != nil {
+				return err
+			}
+		case "fail_open":
+			if err := parseFlag(d, &a.FailOpen); err != nil {
+				return err
+			}
+		default:
+			return d.Errf("unrecognized allowlist subdirective '%s'", d.Val())
+		}
+	}
+	return nil
+}
+
+// parseSingleArg reads exactly one argument for the current subdirective into dst.
+func parseSingleArg(d *caddyfile.Dispenser, dst *string) error {
+	if !d.NextArg() {
+		return d.ArgErr()
+	}
+	*dst = d.Val()
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	return nil
+}
+
+// parseFlag enables a boolean option given as a subdirective without arguments.
+func parseFlag(d *caddyfile.Dispenser, dst *bool) error {
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	*dst = true
+	return nil
+}
+
+// parseDuration reads exactly one duration argument for the current subdirective into dst.
+func parseDuration(d *caddyfile.Dispenser, dst *caddy.Duration) error {
+	name := d.Val()
+	var val string
+	if err := parseSingleArg(d, &val); err != nil {
+		return err
+	}
+	dur, err := caddy.ParseDuration(val)
+	if err != nil {
+		return d.Errf("parsing %s: %v", name, err)
+	}
+	*dst = caddy.Duration(dur)
+	return nil
+}
+
+// parseInt reads exactly one integer argument for the current subdirective into dst.
+func parseInt(d *caddyfile.Dispenser, dst *int) error {
+	name := d.Val()
+	var val string
+	if err := parseSingleArg(d, &val); err != nil {
+		return err
+	}
+	n, err := strconv.Atoi(val)
+	if err != nil {
+		return d.Errf("parsing %s: %v", name, err)
+	}
+	*dst = n
+	return nil
+}
@@ -0,0 +1,63 @@
+package caddy_matchtoken
+
+import (
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+)
+
+// checksumModes are the checks accepted for ChecksumMode.
+var checksumModes = map[string]func(token string) bool{
+	"mod10": validMod10,
+	"crc32": validCRC32,
+}
+
+func (m *MatchToken) provisionChecksum() error {
+	if m.ChecksumMode == "" {
+		return nil
+	}
+	valid, ok := checksumModes[m.ChecksumMode]
+	if !ok {
+		return fmt.Errorf("unrecognized checksum_mode '%s'", m.ChecksumMode)
+	}
+	m.checksumValid = valid
+	return nil
+}
+
+// validMod10 reports whether the digits ending the token, at least two, pass
+// the Luhn check: their last digit is the check digit of the others.
+func validMod10(token string) bool {
+	i := len(token)
+	for i > 0 && token[i-1] >= '0' && token[i-1] <= '9' {
+		i--
+	}
+	digits := token[i:]
+	if len(digits) < 2 {
+		return false
+	}
+	var sum int
+	for j := len(digits) - 1; j >= 0; j-- {
+		d := int(digits[j] - '0')
+		if (len(digits)-j)%2 == 0 {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	return sum%10 == 0
+}
+
+// validCRC32 reports whether the token ends with 8 hex digits holding the
+// CRC-32 (IEEE) of the rest of the token, in big-endian order.
+func validCRC32(token string) bool {
+	if len(token) <= 8 {
+		return false
+	}
+	sum, err := hex.DecodeString(token[len(token)-8:])
+	if err != nil {
+		return false
+	}
+	want := uint32(sum[0])<<24 | uint32(sum[1])<<16 | uint32(sum[2])<<8 | uint32(sum[3])
+	return crc32.ChecksumIEEE([]byte(token[:len(token)-8])) == want
+}
@@ -0,0 +1,74 @@
+// Command matchtoken-bloom builds a bloom filter file for the
+// bloom_filter_file option of the matchToken matcher from a list of
+// accepted tokens, one per line. Blank lines are ignored.
+//
+//	matchtoken-bloom [-fp 0.001] -o tokens.bloom [files...]
+//
+// Tokens are read from the files, or from standard input if none is given.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	caddy_matchtoken "github.com/mcomsolutions/caddy-matchtoken"
+)
+
+func main() {
+	fp := flag.Float64("fp", 0.001, "false positive rate")
+	out := flag.String("o", "", "output file (required)")
+	flag.Parse()
+	if *out == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err := run(*out, *fp, flag.Args()); err != nil {
+		fmt.Fprintln(os.Stderr, "matchtoken-bloom:", err)
+		os.Exit(1)
+	}
+}
+
+func run(out string, fp float64, files []string) error {
+	var tokens []string
+	if len(files) == 0 {
+		var err error
+		if tokens, err = readTokens(os.Stdin, tokens); err != nil {
+			return err
+		}
+	}
+	for _, name := range files {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		tokens, err = readTokens(f, tokens)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	f, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	if err := caddy_matchtoken.WriteBloomFilter(f, tokens, fp); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func readTokens(r io.Reader, tokens []string) ([]string, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		if token := strings.TrimSpace(scanner.Text()); token != "" {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens, scanner.Err()
+}
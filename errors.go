@@ -0,0 +1,59 @@
+package caddy_matchtoken
+
+import "errors"
+
+// ErrorCategory classifies the errors returned by Provision, for tools that
+// generate configurations and react to each kind of mistake differently.
+type ErrorCategory string
+
+const (
+	// CategoryInvalidOption is an option with an invalid value, or options
+	// that can not be combined.
+	CategoryInvalidOption ErrorCategory = "invalid_option"
+
+	// CategoryDuplicateHost is a host listed more than once.
+	CategoryDuplicateHost ErrorCategory = "duplicate_host"
+
+	// CategoryInvalidHost is a host entry that can not be converted to ASCII,
+	// or an invalid host pattern or regular expression.
+	CategoryInvalidHost ErrorCategory = "invalid_host"
+
+	// CategoryFile is a host or prefix file that can not be read.
+	CategoryFile ErrorCategory = "file"
+
+	// CategoryFetch is a remote resource, such as a JWKS, that can not be
+	// fetched or decoded.
+	CategoryFetch ErrorCategory = "fetch"
+)
+
+// ProvisionError is the type of the errors returned by Provision. Its message
+// is the same as that of the underlying error, which Unwrap returns.
+type ProvisionError struct {
+	category ErrorCategory
+	err      error
+}
+
+func (e *ProvisionError) Error() string { return e.err.Error() }
+
+func (e *ProvisionError) Unwrap() error { return e.err }
+
+// Category returns the kind of the error.
+func (e *ProvisionError) Category() ErrorCategory { return e.category }
+
+// categorized marks err as being of category.
+func categorized(category ErrorCategory, err error) error {
+	return &ProvisionError{category: category, err: err}
+}
+
+// asProvisionError returns err as a ProvisionError, keeping the category of
+// a ProvisionError it wraps, if any, and CategoryInvalidOption otherwise.
+func asProvisionError(err error) error {
+	var pe *ProvisionError
+	if !errors.As(err, &pe) {
+		return categorized(CategoryInvalidOption, err)
+	}
+	if pe == err {
+		return err
+	}
+	return categorized(pe.category, err)
+}
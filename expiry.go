@@ -0,0 +1,56 @@
+package caddy_matchtoken
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// ExpiryConfig reads an expiry time embedded in the token, such as
+// "<data>.<unixtime>", and rejects expired tokens.
+type ExpiryConfig struct {
+	// Separator splits the token into parts. Defaults to ".".
+	Separator string `json:"separator,omitempty"`
+
+	// Position is the index of the part holding the expiry as Unix seconds;
+	// negative values count from the end. Defaults to the last part.
+	Position *int `json:"position,omitempty"`
+
+	// Skew tolerates clock differences with the token issuer: a token is
+	// still accepted up to Skew after its expiry.
+	Skew caddy.Duration `json:"skew,omitempty"`
+}
+
+func (e *ExpiryConfig) provision() error {
+	if e.Separator == "" {
+		e.Separator = "."
+	}
+	if e.Skew < 0 {
+		return fmt.Errorf("expiry: skew must not be negative")
+	}
+	return nil
+}
+
+// valid reports whether the token carries an expiry that has not passed at
+// now. A missing or malformed expiry fails the check.
+func (e *ExpiryConfig) valid(token string, now time.Time) bool {
+	parts := strings.Split(token, e.Separator)
+	pos := len(parts) - 1
+	if e.Position != nil {
+		pos = *e.Position
+		if pos < 0 {
+			pos += len(parts)
+		}
+	}
+	if len(parts) < 2 || pos < 0 || pos >= len(parts) {
+		return false
+	}
+	exp, err := strconv.ParseInt(parts[pos], 10, 64)
+	if err != nil {
+		return false
+	}
+	return !now.After(time.Unix(exp, 0).Add(time.Duration(e.Skew)))
+}
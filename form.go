@@ -0,0 +1,51 @@
+package caddy_matchtoken
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+)
+
+// maxFormTokenBytes bounds how much of a request body is buffered to look for
+// the token form field.
+const maxFormTokenBytes = 1 << 20
+
+// formToken reads the FormField value from an urlencoded request body. The
+// body is buffered and put back in place so handlers downstream still see it
+// unchanged; bodies of other content types are not touched. The body is read
+// once per request: the restored body keeps the parsed form, which later
+// calls, for other rules or sources, reuse.
+func (m *MatchToken) formToken(req *http.Request) string {
+	if body, ok := req.Body.(*formBody); ok {
+		return body.values.Get(m.FormField)
+	}
+	if req.Body == nil || req.Body == http.NoBody {
+		return ""
+	}
+	mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/x-www-form-urlencoded" {
+		return ""
+	}
+	buf, err := io.ReadAll(io.LimitReader(req.Body, maxFormTokenBytes))
+	body := &formBody{Reader: io.MultiReader(bytes.NewReader(buf), req.Body), Closer: req.Body}
+	req.Body = body
+	if err != nil || len(buf) == maxFormTokenBytes {
+		return ""
+	}
+	values, err := url.ParseQuery(string(buf))
+	if err != nil {
+		return ""
+	}
+	body.values = values
+	return values.Get(m.FormField)
+}
+
+// formBody reads from the restored body and closes the original one. values
+// holds the form parsed from it, or nil if it could not be parsed.
+type formBody struct {
+	io.Reader
+	io.Closer
+	values url.Values
+}
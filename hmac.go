@@ -0,0 +1,53 @@
+package caddy_matchtoken
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"strings"
+)
+
+// hmacAlgos are the hash functions accepted for HMACAlgo.
+var hmacAlgos = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha384": sha512.New384,
+	"sha512": sha512.New,
+}
+
+func (m *MatchToken) provisionHMAC() error {
+	if m.HMACSecret == "" && m.HMACAlgo == "" {
+		return nil
+	}
+	if m.HMACSecret == "" {
+		return fmt.Errorf("hmac_secret is required when hmac_algo is set")
+	}
+	if m.HMACAlgo == "" {
+		m.HMACAlgo = "sha256"
+	}
+	newHash, ok := hmacAlgos[m.HMACAlgo]
+	if !ok {
+		return fmt.Errorf("unrecognized hmac_algo '%s'", m.HMACAlgo)
+	}
+	m.hmacHash = newHash
+	return nil
+}
+
+// validHMAC reports whether the token has the form "<payload>.<hex-hmac>" and
+// the signature is the HMAC of the payload under HMACSecret.
+func (m *MatchToken) validHMAC(token string) bool {
+	i := strings.LastIndexByte(token, '.')
+	if i < 0 {
+		return false
+	}
+	sig, err := hex.DecodeString(token[i+1:])
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(m.hmacHash, []byte(m.HMACSecret))
+	mac.Write([]byte(token[:i]))
+	return subtle.ConstantTimeCompare(sig, mac.Sum(nil)) == 1
+}
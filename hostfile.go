@@ -0,0 +1,132 @@
+package caddy_matchtoken
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// readListFile reads one entry per line from the file at path. Surrounding
+// white space is trimmed, and blank lines and lines starting with # are skipped.
+func readListFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries = append(entries, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// readHostFile reads the hosts listed in path, rejecting entries that can not
+// be valid hostnames.
+func readHostFile(path string) ([]string, error) {
+	hosts, err := readListFile(path)
+	if err != nil {
+		return nil, categorized(CategoryFile, fmt.Errorf("reading host file: %v", err))
+	}
+	for _, host := range hosts {
+		if strings.HasPrefix(strings.TrimPrefix(host, "!"), "~") {
+			continue
+		}
+		if strings.ContainsAny(host, " \t") {
+			return nil, categorized(CategoryInvalidHost, fmt.Errorf("host file %s: malformed hostname '%s'", path, host))
+		}
+		if _, err := hostToASCII(strings.TrimPrefix(host, "!")); err != nil {
+			return nil, categorized(CategoryInvalidHost, fmt.Errorf("host file %s: converting hostname '%s' to ASCII: %v", path, host, err))
+		}
+	}
+	return hosts, nil
+}
+
+// watchFiles polls HostFile and PrefixFile every interval until stop is
+// closed, swapping in the new entries whenever a file's modification time
+// changes. If a file can not be read or is invalid, the previous entries are
+// kept and the reload is retried on the next tick.
+func (m *MatchToken) watchFiles(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		if m.HostFile != "" {
+			m.reloadHostFile()
+		}
+		if m.PrefixFile != "" {
+			m.reloadPrefixFile()
+		}
+	}
+}
+
+func (m *MatchToken) reloadHostFile() {
+	info, err := os.Stat(m.HostFile)
+	if err != nil {
+		m.logger.Warn("checking host file", zap.String("file", m.HostFile), zap.Error(err))
+		return
+	}
+	if info.ModTime().Equal(m.hostFileMod) {
+		return
+	}
+	set, err := m.loadHosts()
+	if err != nil {
+		m.logger.Warn("reloading host file; keeping previous hosts", zap.String("file", m.HostFile), zap.Error(err))
+		return
+	}
+	m.hostFileMod = info.ModTime()
+	m.reloadMu.Lock()
+	m.hostSet = set
+	m.reloadMu.Unlock()
+	m.clearDecisions()
+	m.logger.Info("reloaded host file", zap.String("file", m.HostFile), zap.Int("hosts", set.include.size()))
+}
+
+// clearDecisions drops the cached decisions of m and of its rules, which
+// share its excluded hosts.
+func (m *MatchToken) clearDecisions() {
+	for _, r := range append([]*MatchToken{m}, append(m.rules, m.hostRules...)...) {
+		if r.decisions != nil {
+			r.decisions.clear()
+		}
+	}
+}
+
+func (m *MatchToken) reloadPrefixFile() {
+	info, err := os.Stat(m.PrefixFile)
+	if err != nil {
+		m.logger.Warn("checking prefix file", zap.String("file", m.PrefixFile), zap.Error(err))
+		return
+	}
+	if info.ModTime().Equal(m.prefixFileMod) {
+		return
+	}
+	prefixes, err := m.loadPrefixes()
+	if err != nil {
+		m.logger.Warn("reloading prefix file; keeping previous prefixes", zap.String("file", m.PrefixFile), zap.Error(err))
+		return
+	}
+	m.prefixFileMod = info.ModTime()
+	m.reloadMu.Lock()
+	m.prefixes = prefixes
+	m.reloadMu.Unlock()
+	m.clearDecisions()
+	m.logger.Info("reloaded prefix file", zap.String("file", m.PrefixFile), zap.Int("prefixes", len(prefixes)))
+}
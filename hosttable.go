@@ -0,0 +1,50 @@
+package caddy_matchtoken
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// hostTable stores sorted hosts back to back in a single string, indexed by
+// the offset where each one ends. Compared to a []string it saves the 16-byte
+// string header and the separate allocation of every host, which matters for
+// lists of hundreds of thousands of hosts, and keeps them contiguous in memory
+// for the binary search.
+type hostTable struct {
+	data string
+	ends []uint32
+}
+
+// newHostTable builds a table from hosts, which must be sorted.
+func newHostTable(hosts []string) (*hostTable, error) {
+	var b strings.Builder
+	ends := make([]uint32, len(hosts))
+	for i, host := range hosts {
+		if uint64(b.Len())+uint64(len(host)) > math.MaxUint32 {
+			return nil, fmt.Errorf("host list too large for compact lookup")
+		}
+		b.WriteString(host)
+		ends[i] = uint32(b.Len())
+	}
+	return &hostTable{data: b.String(), ends: ends}, nil
+}
+
+func (t *hostTable) len() int {
+	return len(t.ends)
+}
+
+func (t *hostTable) at(i int) string {
+	var start uint32
+	if i > 0 {
+		start = t.ends[i-1]
+	}
+	return t.data[start:t.ends[i]]
+}
+
+// contains reports whether host is in the table using binary search.
+func (t *hostTable) contains(host string) bool {
+	i := sort.Search(len(t.ends), func(i int) bool { return t.at(i) >= host })
+	return i < len(t.ends) && t.at(i) == host
+}
@@ -0,0 +1,371 @@
+package caddy_matchtoken
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"math/big"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// JWTConfig verifies the token as a JSON Web Token and optionally requires
+// one of its claims to have an expected value.
+type JWTConfig struct {
+	// Secret is the shared secret for HS256, HS384 and HS512 tokens.
+	Secret string `json:"secret,omitempty"`
+
+	// JWKSURL is fetched at provisioning for the public keys verifying RS256,
+	// RS384, RS512, ES256, ES384 and ES512 tokens.
+	JWKSURL string `json:"jwks_url,omitempty"`
+
+	// RefreshInterval, if set, is how often JWKSURL is fetched again to pick
+	// up rotated keys. Each wait varies randomly by up to a tenth of the
+	// interval, so that instances do not refresh in lockstep. When a refresh
+	// fails, the previous keys are kept.
+	RefreshInterval caddy.Duration `json:"refresh_interval,omitempty"`
+
+	// Claim, if set, must be present in the payload and equal Value. If the
+	// claim is an array, any of its elements may equal Value.
+	Claim string `json:"claim,omitempty"`
+	Value string `json:"value,omitempty"`
+
+	// Leeway tolerates clock skew when checking the exp and nbf claims.
+	Leeway caddy.Duration `json:"leeway,omitempty"`
+
+	mu     sync.RWMutex // guards keys
+	keys   map[string]crypto.PublicKey
+	logger *zap.Logger
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// jwtHeader is the part of the JOSE header needed for verification.
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+func (j *JWTConfig) provision(logger *zap.Logger) error {
+	if (j.Secret == "") == (j.JWKSURL == "") {
+		return fmt.Errorf("jwt: exactly one of secret or jwks_url is required")
+	}
+	if j.RefreshInterval < 0 {
+		return fmt.Errorf("jwt: refresh_interval must not be negative")
+	}
+	if j.RefreshInterval > 0 && j.JWKSURL == "" {
+		return fmt.Errorf("jwt: refresh_interval requires jwks_url")
+	}
+	j.logger = logger
+	if j.JWKSURL != "" {
+		keys, err := fetchJWKS(j.JWKSURL)
+		if err != nil {
+			return categorized(CategoryFetch, fmt.Errorf("jwt: %v", err))
+		}
+		j.keys = keys
+	}
+	if j.RefreshInterval > 0 {
+		j.stop = make(chan struct{})
+		j.done = make(chan struct{})
+		go j.refreshKeys(time.Duration(j.RefreshInterval), j.stop, j.done)
+	}
+	return nil
+}
+
+// cleanup stops the key refresh, if running.
+func (j *JWTConfig) cleanup() {
+	if j.stop != nil {
+		close(j.stop)
+		<-j.done
+		j.stop = nil
+	}
+}
+
+// refreshKeys fetches JWKSURL about every interval until stop is closed.
+func (j *JWTConfig) refreshKeys(interval time.Duration, stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	for {
+		timer := time.NewTimer(jitter(interval))
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		keys, err := fetchJWKS(j.JWKSURL)
+		if err != nil {
+			j.logger.Warn("refreshing JWKS; keeping previous keys", zap.String("url", j.JWKSURL), zap.Error(err))
+			continue
+		}
+		j.mu.Lock()
+		j.keys = keys
+		j.mu.Unlock()
+	}
+}
+
+// jitter returns d varied randomly by up to a tenth either way.
+func jitter(d time.Duration) time.Duration {
+	spread := int64(d / 10)
+	if spread <= 0 {
+		return d
+	}
+	return d + time.Duration(rand.Int63n(2*spread+1)-spread)
+}
+
+// verify reports whether token is a validly signed, unexpired JWT carrying
+// the configured claim. Any parsing error fails the verification.
+func (j *JWTConfig) verify(token string) bool {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return false
+	}
+	var header jwtHeader
+	if err := decodeJWTSegment(parts[0], &header); err != nil {
+		return false
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	if !j.verifySignature(header, parts[0]+"."+parts[1], sig) {
+		return false
+	}
+	var claims map[string]any
+	if err := decodeJWTSegment(parts[1], &claims); err != nil {
+		return false
+	}
+	return j.checkClaims(claims, time.Now())
+}
+
+func (j *JWTConfig) verifySignature(header jwtHeader, signed string, sig []byte) bool {
+	if len(header.Alg) != 5 {
+		return false
+	}
+	var newHash func() hash.Hash
+	var cryptoHash crypto.Hash
+	switch header.Alg[2:] {
+	case "256":
+		newHash, cryptoHash = sha256.New, crypto.SHA256
+	case "384":
+		newHash, cryptoHash = sha512.New384, crypto.SHA384
+	case "512":
+		newHash, cryptoHash = sha512.New, crypto.SHA512
+	default:
+		return false
+	}
+
+	if header.Alg[:2] == "HS" {
+		if j.Secret == "" {
+			return false
+		}
+		mac := hmac.New(newHash, []byte(j.Secret))
+		mac.Write([]byte(signed))
+		return hmac.Equal(sig, mac.Sum(nil))
+	}
+
+	h := newHash()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+	j.mu.RLock()
+	keys := j.keys
+	j.mu.RUnlock()
+	for kid, key := range keys {
+		if header.Kid != "" && kid != header.Kid {
+			continue
+		}
+		switch key := key.(type) {
+		case *rsa.PublicKey:
+			if header.Alg[:2] == "RS" && rsa.VerifyPKCS1v15(key, cryptoHash, digest, sig) == nil {
+				return true
+			}
+		case *ecdsa.PublicKey:
+			size := (key.Curve.Params().BitSize + 7) / 8
+			if header.Alg[:2] != "ES" || len(sig) != 2*size {
+				continue
+			}
+			r := new(big.Int).SetBytes(sig[:size])
+			s := new(big.Int).SetBytes(sig[size:])
+			if ecdsa.Verify(key, digest, r, s) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (j *JWTConfig) checkClaims(claims map[string]any, now time.Time) bool {
+	leeway := time.Duration(j.Leeway)
+	if exp, ok := claims["exp"]; ok {
+		n, ok := exp.(float64)
+		if !ok || now.After(time.Unix(int64(n), 0).Add(leeway)) {
+			return false
+		}
+	}
+	if nbf, ok := claims["nbf"]; ok {
+		n, ok := nbf.(float64)
+		if !ok || now.Before(time.Unix(int64(n), 0).Add(-leeway)) {
+			return false
+		}
+	}
+	if j.Claim == "" {
+		return true
+	}
+	return claimHasValue(claims[j.Claim], j.Value)
+}
+
+// claimHasValue reports whether the claim equals value or, for arrays,
+// contains an element equal to value.
+func claimHasValue(claim any, value string) bool {
+	switch claim := claim.(type) {
+	case nil:
+		return false
+	case string:
+		return claim == value
+	case []any:
+		for _, v := range claim {
+			if claimHasValue(v, value) {
+				return true
+			}
+		}
+		return false
+	default:
+		return fmt.Sprint(claim) == value
+	}
+}
+
+// unverifiedAudience reports whether token has the shape of a JWT whose
+// payload, decoded without checking the signature, has an aud claim equal to
+// or containing one of audiences.
+func unverifiedAudience(token string, audiences []string) bool {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return false
+	}
+	var claims struct {
+		Aud any `json:"aud"`
+	}
+	if err := decodeJWTSegment(parts[1], &claims); err != nil {
+		return false
+	}
+	for _, aud := range audiences {
+		if claimHasValue(claims.Aud, aud) {
+			return true
+		}
+	}
+	return false
+}
+
+func decodeJWTSegment(segment string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// jwk is the subset of a JSON Web Key needed for RSA and EC public keys.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// fetchJWKS downloads a JSON Web Key Set and returns its keys by key ID.
+// Keys of unsupported types or curves are skipped.
+func fetchJWKS(url string) (map[string]crypto.PublicKey, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("fetching JWKS: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching JWKS from %s: unexpected status %s", url, resp.Status)
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&set); err != nil {
+		return nil, fmt.Errorf("decoding JWKS from %s: %v", url, err)
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for i, k := range set.Keys {
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("JWKS key at index %d: %v", i, err)
+		}
+		if key == nil {
+			continue
+		}
+		kid := k.Kid
+		if kid == "" {
+			kid = fmt.Sprintf("#%d", i)
+		}
+		keys[kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("JWKS from %s has no usable keys", url)
+	}
+	return keys, nil
+}
+
+// publicKey returns the key described by k, or nil for key types and curves
+// that are not supported.
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("decoding modulus: %v", err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("decoding exponent: %v", err)
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			// skipped like unsupported key types, so other keys stay usable
+			return nil, nil
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("decoding x: %v", err)
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("decoding y: %v", err)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	default:
+		return nil, nil
+	}
+}
@@ -0,0 +1,29 @@
+package caddy_matchtoken
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFetchJWKSUnsupportedCurve(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		fmt.Fprint(w, `{"keys": [
+			{"kty": "EC", "kid": "ec", "crv": "secp256k1", "x": "AQ", "y": "AQ"},
+			{"kty": "RSA", "kid": "rsa", "n": "AQAB", "e": "AQAB"}
+		]}`)
+	}))
+	defer srv.Close()
+
+	keys, err := fetchJWKS(srv.URL)
+	if err != nil {
+		t.Fatalf("fetching JWKS: %v", err)
+	}
+	if _, ok := keys["ec"]; ok {
+		t.Error("the key with an unsupported curve was not skipped")
+	}
+	if _, ok := keys["rsa"]; !ok {
+		t.Error("the RSA key is missing")
+	}
+}
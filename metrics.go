@@ -0,0 +1,26 @@
+package caddy_matchtoken
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// matchTokenMetrics is shared by every matcher instance; it is registered
+// once, the first time a matcher with metrics enabled is provisioned.
+var matchTokenMetrics = struct {
+	init    sync.Once
+	results *prometheus.CounterVec
+}{
+	init: sync.Once{},
+}
+
+func initMatchTokenMetrics() {
+	matchTokenMetrics.results = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "caddy",
+		Subsystem: "http_matchtoken",
+		Name:      "results_total",
+		Help:      "Counter of matchToken matcher outcomes.",
+	}, []string{"result"})
+}
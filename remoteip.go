@@ -0,0 +1,65 @@
+package caddy_matchtoken
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// parseRanges parses CIDRs and bare IP addresses, the latter as single
+// address prefixes.
+func parseRanges(ranges []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(ranges))
+	for _, r := range ranges {
+		if strings.Contains(r, "/") {
+			prefix, err := netip.ParsePrefix(r)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CIDR '%s': %v", r, err)
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(strings.Trim(r, "[]"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP address '%s': %v", r, err)
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+// clientIP returns the client address as determined by the server, which
+// honors X-Forwarded-For only from the server's trusted_proxies, falling back
+// to the connection's remote address.
+func clientIP(req *http.Request) (netip.Addr, error) {
+	address, _ := caddyhttp.GetVar(req.Context(), caddyhttp.ClientIPVarKey).(string)
+	if address == "" {
+		address = req.RemoteAddr
+		if host, _, err := net.SplitHostPort(address); err == nil {
+			address = host
+		}
+	}
+	address = strings.Trim(address, "[]")
+	if i := strings.IndexByte(address, '%'); i >= 0 {
+		address = address[:i] // drop the IPv6 zone
+	}
+	addr, err := netip.ParseAddr(address)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	return addr.Unmap(), nil
+}
+
+// inRanges reports whether addr is within any of the prefixes.
+func inRanges(addr netip.Addr, prefixes []netip.Prefix) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,173 @@
+package caddy_matchtoken
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// TokenRule pairs a token prefix with the hosts it is accepted on, as an
+// entry of MatchToken.Rules.
+type TokenRule struct {
+	// Prefix is the token prefix of the rule. Required.
+	Prefix string `json:"tokenprefix"`
+
+	// Host lists the hosts of the rule, in the forms accepted by
+	// MatchToken.Host. Required.
+	Host []string `json:"host"`
+}
+
+// HostPrefix attaches a token prefix to a single host entry, as an entry of
+// MatchToken.HostPrefixes.
+type HostPrefix struct {
+	// Host is a host entry in the forms accepted by MatchToken.Host, except
+	// negated ones.
+	Host string `json:"host"`
+
+	// Prefix is the token prefix accepted on Host. When empty, the top-level
+	// prefixes apply.
+	Prefix string `json:"tokenprefix"`
+}
+
+// provisionRules builds a matcher for each rule. A rule matcher is a copy of
+// m, already provisioned, with its own prefix and host list; every other
+// option is shared, and so are the hosts m excludes. Host lists are
+// deduplicated and prepared per rule.
+func (m *MatchToken) provisionRules() error {
+	m.implicitRule = (len(m.Rules) == 0 && len(m.HostPrefixes) == 0) || len(m.Host) > 0 || m.HostFile != "" || m.MatchAnyHost
+	for i, rule := range m.Rules {
+		if rule.Prefix == "" {
+			return fmt.Errorf("rule %d: tokenprefix is required", i)
+		}
+		if len(rule.Host) == 0 {
+			return fmt.Errorf("rule %d: no hosts configured", i)
+		}
+		r, err := m.newRule(rule.Prefix, rule.Host)
+		if err != nil {
+			return fmt.Errorf("rule %d: %w", i, err)
+		}
+		m.rules = append(m.rules, r)
+	}
+	return m.provisionHostPrefixes()
+}
+
+// newRule returns a copy of m matching prefix on hosts. An empty prefix keeps
+// the prefixes of m, with those of PrefixFile as currently loaded.
+func (m *MatchToken) newRule(prefix string, hosts []string) (*MatchToken, error) {
+	r := *m
+	r.PrefixFile = ""
+	if prefix != "" {
+		r.Prefix = []string{prefix}
+		r.PrefixTemplate, r.prefixTemplates = "", nil
+	}
+	r.Host, r.staticHosts, r.HostFile = hosts, hosts, ""
+	r.MatchAnyHost, r.RequireHostMatch = false, nil
+	r.Rules, r.rules = nil, nil
+	r.HostPrefixes, r.hostRules = nil, nil
+	r.reloadMu, r.stopReload, r.reloadDone = nil, nil, nil
+	r.parent = m
+	if prefix != "" {
+		if err := r.provisionPrefixes(); err != nil {
+			return nil, err
+		}
+		r.prefixes = r.Prefix
+	}
+	set, err := r.loadHosts()
+	if err != nil {
+		return nil, err
+	}
+	r.hostSet = set
+	return &r, nil
+}
+
+// provisionHostPrefixes builds a rule for each prefix of HostPrefixes, with
+// the hosts attached to it, so they are prepared and looked up together.
+func (m *MatchToken) provisionHostPrefixes() error {
+	var prefixes []string
+	hosts := make(map[string][]string)
+	seen := make(map[string]int, len(m.HostPrefixes))
+	for i, hp := range m.HostPrefixes {
+		if hp.Host == "" {
+			return fmt.Errorf("host prefix %d: host is required", i)
+		}
+		if hp.Prefix == "" && !m.hasPrefixes() {
+			return fmt.Errorf("host prefix %d: tokenprefix is required without a top-level prefix", i)
+		}
+		if strings.HasPrefix(hp.Host, "!") {
+			return fmt.Errorf("host prefix %d: host can not be negated: %s", i, hp.Host)
+		}
+		// a host attached to two prefixes would only ever use the first one
+		host := m.normalizeHost(hp.Host)
+		if firstI, ok := seen[host]; ok {
+			return categorized(CategoryDuplicateHost, fmt.Errorf("host prefix at index %d repeats the host at index %d: %s", i, firstI, hp.Host))
+		}
+		seen[host] = i
+		if _, ok := hosts[hp.Prefix]; !ok {
+			prefixes = append(prefixes, hp.Prefix)
+		}
+		hosts[hp.Prefix] = append(hosts[hp.Prefix], hp.Host)
+	}
+	for _, prefix := range prefixes {
+		r, err := m.newRule(prefix, hosts[prefix])
+		if err != nil {
+			return fmt.Errorf("host prefix '%s': %w", prefix, err)
+		}
+		m.hostRules = append(m.hostRules, r)
+	}
+	return nil
+}
+
+// hostPrefixFallback reports whether an entry of HostPrefixes has no prefix
+// and so takes the top-level ones.
+func (m *MatchToken) hostPrefixFallback() bool {
+	for _, hp := range m.HostPrefixes {
+		if hp.Prefix == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// evaluate matches the request against the rule formed by Prefix and Host,
+// if any, and then against Rules. It returns the first matching outcome, or
+// the outcome of the first rule evaluated if none matches. A request for a
+// host of HostPrefixes is only matched against the prefix of that host.
+func (m *MatchToken) evaluate(req *http.Request) matchOutcome {
+	for _, r := range m.hostRules {
+		if r.hasRequestHost(req) {
+			return r.match(req)
+		}
+	}
+	var first matchOutcome
+	if m.implicitRule {
+		first = m.match(req)
+		if first.result == resultMatch {
+			return first
+		}
+	}
+	for i, r := range m.rules {
+		out := r.match(req)
+		if out.result == resultMatch {
+			return out
+		}
+		if i == 0 && !m.implicitRule {
+			first = out
+		}
+	}
+	if first.result == "" {
+		// only HostPrefixes are used, and none has the request host
+		first.result = resultHostMiss
+		first.host, _ = m.hostAndPort(req)
+	}
+	return first
+}
+
+// hasRequestHost reports whether the request host is one of m's hosts.
+func (m *MatchToken) hasRequestHost(req *http.Request) bool {
+	reqHost, _ := m.hostAndPort(req)
+	repl, _ := req.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	_, found := m.matchedHost(reqHost, repl)
+	return found
+}
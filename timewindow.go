@@ -0,0 +1,97 @@
+package caddy_matchtoken
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// timeWindow is a daily range of minutes since midnight, from start
+// (inclusive) to end (exclusive). A window with end before start spans
+// midnight.
+type timeWindow struct {
+	start, end int
+}
+
+// parseTimeWindow parses a window written as "HH:MM-HH:MM", such as
+// "22:00-06:00". The end may be "24:00".
+func parseTimeWindow(s string) (timeWindow, error) {
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return timeWindow{}, fmt.Errorf("invalid time window '%s': expected HH:MM-HH:MM", s)
+	}
+	start, err := parseClock(from, false)
+	if err != nil {
+		return timeWindow{}, fmt.Errorf("invalid time window '%s': %v", s, err)
+	}
+	end, err := parseClock(to, true)
+	if err != nil {
+		return timeWindow{}, fmt.Errorf("invalid time window '%s': %v", s, err)
+	}
+	if start == end {
+		return timeWindow{}, fmt.Errorf("invalid time window '%s': start and end are the same time", s)
+	}
+	return timeWindow{start: start, end: end}, nil
+}
+
+// parseClock parses "HH:MM" into minutes since midnight, accepting "24:00"
+// if end.
+func parseClock(s string, end bool) (int, error) {
+	hh, mm, ok := strings.Cut(strings.TrimSpace(s), ":")
+	h, err1 := strconv.Atoi(hh)
+	m, err2 := strconv.Atoi(mm)
+	if !ok || len(hh) != 2 || len(mm) != 2 || err1 != nil || err2 != nil || m < 0 || m > 59 || h < 0 {
+		return 0, fmt.Errorf("invalid time '%s'", s)
+	}
+	if h > 23 && !(end && h == 24 && m == 0) {
+		return 0, fmt.Errorf("invalid time '%s'", s)
+	}
+	return h*60 + m, nil
+}
+
+// contains reports whether the time of day of t is within the window.
+func (w timeWindow) contains(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	if w.start < w.end {
+		return minute >= w.start && minute < w.end
+	}
+	return minute >= w.start || minute < w.end
+}
+
+func (m *MatchToken) provisionTimeWindows() error {
+	if m.clock == nil {
+		m.clock = time.Now
+	}
+	if m.TimeZone != "" && len(m.TimeWindows) == 0 {
+		return fmt.Errorf("time_zone requires time_windows")
+	}
+	m.location = time.Local
+	if m.TimeZone != "" {
+		loc, err := time.LoadLocation(m.TimeZone)
+		if err != nil {
+			return fmt.Errorf("time_zone: %v", err)
+		}
+		m.location = loc
+	}
+	for _, s := range m.TimeWindows {
+		w, err := parseTimeWindow(s)
+		if err != nil {
+			return err
+		}
+		m.timeWindows = append(m.timeWindows, w)
+	}
+	return nil
+}
+
+// inTimeWindow reports whether the current time, as given by the matcher
+// clock, falls within any of the time windows.
+func (m *MatchToken) inTimeWindow() bool {
+	now := m.clock().In(m.location)
+	for _, w := range m.timeWindows {
+		if w.contains(now) {
+			return true
+		}
+	}
+	return false
+}
@@ -1,13 +1,33 @@
 package caddy_matchtoken
 
 import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
 	"net"
 	"net/http"
+	"net/netip"
+	"os"
+	"path"
+	"regexp"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
 
 	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"golang.org/x/net/http/httpguts"
 	"golang.org/x/net/idna"
 )
 
@@ -15,148 +35,2586 @@ import (
 // xcaddy build --with github.com/mcomsolutions/caddy-storagessl --with github.com/mcomsolutions/caddy-matchtoken=C:\java\eclipse\vertx\caddy-matchtoken
 // .\caddy start --config caddy.json
 
-type matchToken struct {
+// MatchToken is the http.matchers.matchToken module: it matches requests
+// carrying an accepted token for an accepted host. Programs embedding Caddy
+// can build one with NewMatchToken, or set its fields and call Provision and
+// Validate.
+type MatchToken struct {
+	// Prefix lists the accepted token prefixes; a token having any of them passes.
+	// Prefixes may contain placeholders. Global ones such as {env.*} and
+	// {system.*} are resolved once at provisioning; request placeholders such
+	// as {http.request.header.*} or {http.vars.*} are expanded on every request,
+	// and a prefix with a request placeholder that is unknown or empty, such
+	// as a missing header, is ignored for that request.
 	Prefix []string `json:"tokenprefix"`
-	Host   []string `json:"host"`
+
+	// AllowEmptyPrefix accepts an empty string among Prefix, which then
+	// accepts any non-empty token. Without it an empty prefix fails
+	// validation, as it is more likely a mistake. A request without a token,
+	// or with an empty one such as an empty cookie, never satisfies a prefix.
+	AllowEmptyPrefix bool `json:"allow_empty_prefix,omitempty"`
+
+	// MatchMode defines where a token must contain a Prefix entry: "prefix"
+	// (default) at its start, "suffix" at its end, "contains" anywhere, or
+	// "exact" as the whole token. It applies to PrefixTemplate and PrefixFile
+	// entries too, but not to ExcludePrefixes. With ConstantTime, "contains"
+	// still compares in constant time but checks every offset of the token.
+	MatchMode string `json:"match_mode,omitempty"`
+
+	// RequireSeparatorAfterPrefix, if set, requires a prefix to be followed by
+	// this separator unless the token equals the prefix: with "_", the prefix
+	// "v1" accepts "v1" and "v1_abc" but not "v12" nor "v1abc". It only
+	// applies to the "prefix" MatchMode.
+	RequireSeparatorAfterPrefix string `json:"prefix_separator,omitempty"`
+
+	// ExcludePrefixes rejects tokens having any of these prefixes even when
+	// they satisfy Prefix, for example to accept "v" tokens but not "vtest"
+	// ones. They are checked once the token has passed Prefix and Tokens.
+	ExcludePrefixes []string `json:"exclude_prefixes,omitempty"`
+
+	// PrefixFile is a file of newline-separated prefixes accepted in addition
+	// to Prefix. Blank lines and lines starting with # are ignored, and
+	// placeholders are not expanded.
+	PrefixFile string `json:"prefix_file,omitempty"`
+
+	// PrefixEnv, if set, is a pattern of environment variable names, such as
+	// "TOKEN_PREFIX_*", whose values are accepted as prefixes in addition to
+	// Prefix. The pattern has the syntax of path.Match. Variables are read
+	// once, at provisioning, so a change takes effect on the next config
+	// reload, and at least one must be set and not empty.
+	PrefixEnv string `json:"prefix_env,omitempty"`
+
+	// PrefixTemplate is a single prefix expanded on every request, such as
+	// "{http.request.header.X-Tenant}-". When set it takes precedence and
+	// Prefix is ignored. If any of its placeholders is unknown or empty, the
+	// prefix check fails for that request instead of accepting every token
+	// that starts with the rest of the template.
+	PrefixTemplate string `json:"prefix_template,omitempty"`
+
+	// Host lists the accepted request hosts. A "*" label matches exactly one
+	// label, so "*.example.com" matches "a.example.com" but not
+	// "a.b.example.com"; a leading "**" label matches one or more labels, so
+	// "**.example.com" matches both (but not "example.com" itself). Entries
+	// starting with "!" exclude a host: a request whose host matches any of them
+	// does not match, whatever the other entries, including the hosts of Rules
+	// and HostPrefixes. Entries starting with "~"
+	// (or "!~") are regular expressions matched against the lowercased host
+	// (or the host as sent, with CaseSensitiveHost). An entry that is just "*"
+	// is a whole-host wildcard matching every host, unlike "*" as one label of
+	// a longer pattern.
+	//
+	// Wildcard labels may appear in any position and several times, as in
+	// "api.*.example.com" or "*.*.example.com"; each matches exactly one
+	// non-empty label, so the pattern and the host must have the same number
+	// of labels. Labels may also be glob patterns as understood by path.Match:
+	// "?" matches one character, "[0-9]" or "[^a-c]" a character class, and a
+	// backslash escapes a metacharacter, so "api-?.example.com" matches
+	// "api-1.example.com". A trailing dot is dropped from both the entries and the
+	// request host, so "example.com." and "example.com" are equivalent.
+	//
+	// Entries may contain request placeholders, such as
+	// "{http.request.header.X-Tenant}.example.com", expanded for each request.
+	// Expanded values are taken literally: wildcards and glob syntax in them
+	// do not act as patterns. Entries without placeholders are never passed
+	// to the replacer.
+	Host []string `json:"host"`
+
+	// Rules are further pairs of a token prefix and hosts, each matching on
+	// its own: a request matches if its token has the prefix of a rule and its
+	// host is one of that rule's hosts. Prefix and Host form an implicit first
+	// rule when Host, HostFile or MatchAnyHost is set; otherwise the prefix
+	// options are ignored, with a warning. Every other option, such as the
+	// token sources or ports, applies to all rules alike, and negated Host
+	// entries exclude their hosts from every rule.
+	Rules []TokenRule `json:"rules,omitempty"`
+
+	// HostPrefixes attach a token prefix to single host entries, such as
+	// {"host": "a.example.com", "tokenprefix": "a_"}. A request for one of
+	// these hosts is evaluated only against the prefix of its entry, before
+	// and instead of Prefix and Rules; other hosts fall back to them. An entry
+	// without a prefix takes the top-level ones, such as Prefix and
+	// PrefixTemplate; the prefixes of PrefixFile are those loaded at
+	// provisioning. Entries take the same forms as in Host, except negated
+	// ones, and those sharing a prefix are looked up together.
+	HostPrefixes []HostPrefix `json:"host_prefixes,omitempty"`
+
+	// BypassHosts are exempt from every token check: a request for one of them
+	// matches without a token, for example for internal health checks. The
+	// other request conditions, such as RequireTLS or Ports, still apply.
+	// Entries take the same forms as in Host.
+	BypassHosts []string `json:"bypass_hosts,omitempty"`
+
+	// TrustedNoTokenRanges exempt clients within these CIDRs or IP addresses,
+	// IPv4 or IPv6, from the token condition, for instance internal monitoring
+	// that can not send a token. Unlike BypassHosts, the host and the other
+	// request conditions are still checked. The client address is determined
+	// as for RemoteRanges.
+	TrustedNoTokenRanges []string `json:"trusted_no_token_ranges,omitempty"`
+
+	// MatchAnyHost makes the host condition always pass, like a "*" host
+	// entry, for routes whose host is already constrained elsewhere. Negated
+	// host entries still apply.
+	MatchAnyHost bool `json:"match_any_host,omitempty"`
+
+	// AllowEmptyHosts accepts a configuration without hosts, for instance when
+	// they come from a HostFile that may start empty. No request matches while
+	// the host list is empty.
+	AllowEmptyHosts bool `json:"allow_empty_hosts,omitempty"`
+
+	// RequireHostMatch, true by default, makes a request whose host is not
+	// accepted fail even when its token passes. Set it to false for token-only
+	// routes: the host list, which may then be empty, is only used to report
+	// the matched host, and negated entries do not reject a request. Rules
+	// always require their hosts.
+	RequireHostMatch *bool `json:"require_host_match,omitempty"`
+
+	// TrustForwardedHost uses the first X-Forwarded-Host value, when present,
+	// instead of the Host header. Clients can set that header to anything, so
+	// enable this only behind a trusted proxy that overwrites it.
+	TrustForwardedHost bool `json:"trust_forwarded_host,omitempty"`
+
+	// UseTLSSNI matches the server name sent by the client in the TLS
+	// handshake instead of the Host header, on TLS connections with one. The
+	// server name selected the certificate and is fixed for the connection,
+	// while the Host header can name any site on each request, which lets a
+	// client reach a host other than the one it connected to (domain
+	// fronting). The port, for Ports and MatchHostWithPort, is still the one
+	// of the Host header. Other requests use the Host header. It can not be
+	// combined with TrustForwardedHost.
+	UseTLSSNI bool `json:"use_tls_sni,omitempty"`
+
+	// MatchHostWithPort compares the Host header verbatim, port included,
+	// against the host list, so entries like "example.com:8080" can be used.
+	// Wildcard entries may carry a port too, as in "*.example.com:8443": the
+	// labels are matched against the host and the port is compared on its
+	// own. An entry without a port matches only a Host header without one.
+	// Without this option, entries with a port are rejected, as they could
+	// never match.
+	MatchHostWithPort bool `json:"match_host_with_port,omitempty"`
+
+	// CaseSensitiveHost compares hosts exactly instead of ignoring case.
+	CaseSensitiveHost bool `json:"case_sensitive_host,omitempty"`
+
+	// DedupeHosts drops repeated hosts with a warning instead of failing to
+	// provision, so host lists assembled from overlapping sources still load.
+	DedupeHosts bool `json:"dedupe_hosts,omitempty"`
+
+	// RequireTLS restricts matches to requests received over TLS, so tokens
+	// sent in plaintext are never honored. It is evaluated by the matcher
+	// only; it does not redirect plaintext requests to https.
+	RequireTLS bool `json:"require_tls,omitempty"`
+
+	// MinProtoMajor, if set, restricts matches to requests whose HTTP major
+	// version is at least this, such as 2 to refuse HTTP/1.x. HTTP/3 requests
+	// have a major version of 3.
+	MinProtoMajor int `json:"min_proto_major,omitempty"`
+
+	// TimeWindows, if set, restricts matches to these daily time ranges, such
+	// as "22:00-06:00" for off-hours maintenance endpoints. A range is written
+	// "HH:MM-HH:MM", includes its start and excludes its end, and spans
+	// midnight when the end is earlier than the start.
+	TimeWindows []string `json:"time_windows,omitempty"`
+
+	// TimeZone is the IANA time zone of TimeWindows, such as "Europe/Madrid".
+	// Defaults to the local time zone of the server.
+	TimeZone string `json:"time_zone,omitempty"`
+
+	// Methods, if set, restricts matches to requests with one of these HTTP
+	// methods. Methods are compared case-insensitively.
+	Methods []string `json:"methods,omitempty"`
+
+	// HeaderMatches requires each of these request headers to have the given
+	// value, such as {"X-Env": "prod"}. A header sent several times passes if
+	// any of its values is equal.
+	HeaderMatches map[string]string `json:"header_matches,omitempty"`
+
+	// CaseInsensitiveHeaderMatches compares HeaderMatches values ignoring case.
+	CaseInsensitiveHeaderMatches bool `json:"case_insensitive_header_matches,omitempty"`
+
+	// QueryMatches requires each of these query string parameters to have the
+	// given value, such as {"preview": "1"}. A parameter repeated in the query
+	// passes if any of its values is equal.
+	QueryMatches map[string]string `json:"query_matches,omitempty"`
+
+	// Ports, if set, restricts matches to requests on one of these ports. When
+	// the Host header carries no port, 443 is assumed for TLS connections and 80
+	// otherwise.
+	Ports []string `json:"ports,omitempty"`
+
+	// RemoteRanges, if set, restricts matches to clients within these CIDRs or
+	// IP addresses, IPv4 or IPv6. The client address honors X-Forwarded-For
+	// only when the server's trusted_proxies allow it.
+	RemoteRanges []string `json:"remote_ranges,omitempty"`
+
+	// PathPrefixes, if set, restricts matches to request paths under one of
+	// these prefixes. Prefixes match whole path segments: "/api" (or "/api/")
+	// matches "/api", "/api/" and "/api/foo", but not "/apifoo".
+	PathPrefixes []string `json:"path_prefixes,omitempty"`
+
+	// LargeThreshold is the number of exact hosts above which they are looked up
+	// with binary search instead of a linear scan. Defaults to 100.
+	LargeThreshold int `json:"large_threshold,omitempty"`
+
+	// HostMode defines how plain host entries, without wildcards, globs or
+	// placeholders, are compared: "exact" (default) requires the host to equal
+	// the entry; "suffix" accepts any host ending with the entry, so
+	// ".tenant.example.com" matches "a.tenant.example.com". Entries with
+	// wildcards are patterns in both modes.
+	// A suffix without a leading dot also matches longer labels: "example.com"
+	// matches "badexample.com". Negated entries follow the same mode.
+	HostMode string `json:"host_mode,omitempty"`
+
+	// ExactHostLookup selects how hosts without wildcards or placeholders are
+	// looked up: "binary" (default) scans them linearly up to LargeThreshold
+	// and uses binary search above it; "map" keeps them in a hash set for
+	// constant-time lookups, at the cost of more memory; "compact" packs them
+	// into a single string searched with binary search, using the least memory
+	// for lists of hundreds of thousands of hosts. The saving applies to hosts
+	// read from HostFile, as those in Host are also kept as configured.
+	// With the MATCHTOKEN_DEBUG_HOSTS environment variable set, the kinds of
+	// host entries and the lookup in use are logged at debug level.
+	ExactHostLookup string `json:"exact_host_lookup,omitempty"`
+
+	// HostFile is a file of newline-separated hosts merged into Host. Blank lines
+	// and lines starting with # are ignored.
+	HostFile string `json:"host_file,omitempty"`
+
+	// HeaderName is the request header the token is read from. Defaults to
+	// "token" unless HeaderNames is set.
+	HeaderName string `json:"header_name,omitempty"`
+
+	// HeaderNames are further headers tried in order, after HeaderName; the
+	// first non-empty one is used. Useful while migrating header names.
+	HeaderNames []string `json:"header_names,omitempty"`
+
+	// CookieName is the cookie consulted when the headers are absent. Defaults
+	// to "token" unless CookieNames is set.
+	CookieName string `json:"cookie_name,omitempty"`
+
+	// CookieNames are further cookies tried in order, after CookieName; the
+	// first one present is used. Useful while migrating cookie names.
+	CookieNames []string `json:"cookie_names,omitempty"`
+
+	// QueryParam, if set, is the query string parameter used as a last resort.
+	// Sources are tried in order: HeaderName, HeaderNames, Authorization (with
+	// StripBearer), CookieName, CookieNames, query parameter, path segment,
+	// form field, Sec-WebSocket-Protocol, Basic Auth password; the first
+	// non-empty value, or the first cookie or Basic credentials present, wins.
+	QueryParam string `json:"query_param,omitempty"`
+
+	// Sources, if set, lists the token sources to try, in order: header
+	// (HeaderName and HeaderNames), authorization, cookie (CookieName and
+	// CookieNames), query, path, form, websocket_protocol and basic_auth.
+	// Each source still needs its own option, such as QueryParam for query or
+	// ReadBasicAuthPassword for basic_auth. When empty, every enabled source
+	// is tried in the order given for QueryParam.
+	Sources []string `json:"sources,omitempty"`
+
+	// StrictSingleSource rejects requests in which more than one source has a
+	// non-empty token and these tokens differ, instead of using the first one.
+	// Every enabled source is read, in the order of Sources or the default
+	// one, and so is every configured header and cookie name. Tokens are
+	// compared byte for byte after TrimSpace and StripBearer are applied, so
+	// "Bearer abc" in Authorization equals "abc" in a cookie.
+	StrictSingleSource bool `json:"strict_single_source,omitempty"`
+
+	// SplitHeader, if set, splits header values on this separator, as done by
+	// some aggregating gateways; the token condition passes if any of the
+	// white-space-trimmed parts satisfies it.
+	SplitHeader string `json:"split_header,omitempty"`
+
+	// PathTokenIndex, if set, reads the token from the request path segment at
+	// this index, 0 being the first segment: with 0, "/abc123/resource" yields
+	// "abc123". A missing segment yields no token.
+	PathTokenIndex *int `json:"path_token_index,omitempty"`
+
+	// FormField, if set, is read from urlencoded request bodies when no other
+	// source has a token. Up to 1 MiB of the body is buffered in memory to do
+	// so and then restored for downstream handlers; larger bodies are skipped.
+	FormField string `json:"form_field,omitempty"`
+
+	// ReadWebSocketProtocol reads the token from the Sec-WebSocket-Protocol
+	// header, where browser WebSocket clients, unable to set other headers,
+	// usually put it. It is tried after the form field. The first of the
+	// comma-separated subprotocols is used, or with WebSocketProtocolPrefix
+	// the first one having that prefix followed by a value, with the prefix
+	// removed.
+	ReadWebSocketProtocol bool `json:"read_websocket_protocol,omitempty"`
+
+	// WebSocketProtocolPrefix marks the subprotocol carrying the token, as in
+	// the common "token.<value>" convention.
+	WebSocketProtocolPrefix string `json:"websocket_protocol_prefix,omitempty"`
+
+	// ReadBasicAuthPassword reads the token from the password of Basic
+	// credentials in the Authorization header, as sent by "curl -u :<token>".
+	// It is the last source tried. Malformed Basic credentials, or a username
+	// other than BasicAuthUsername when set, reject the request, even with
+	// Negate or MatchNoToken. With StripBearer, the Authorization source
+	// skips Basic credentials so that they reach this one.
+	ReadBasicAuthPassword bool `json:"read_basic_auth_password,omitempty"`
+
+	// BasicAuthUsername, if set, is the username required along with the
+	// token in Basic credentials.
+	BasicAuthUsername string `json:"basic_auth_username,omitempty"`
+
+	// StripBearer removes a leading "Bearer " authentication scheme from the
+	// token and also reads the Authorization header, right after HeaderName.
+	StripBearer bool `json:"strip_bearer,omitempty"`
+
+	// TrimSpace removes leading and trailing white space from the extracted token.
+	TrimSpace bool `json:"trim_space,omitempty"`
+
+	// RequireTokenPresent accepts any non-empty token. Combined with other token
+	// criteria it additionally rejects empty tokens.
+	RequireTokenPresent bool `json:"require_token_present,omitempty"`
+
+	// MinLength and MaxLength, if non-zero, bound the token length in bytes.
+	// Tokens outside the bounds never match, even when negated.
+	MinLength int `json:"min_length,omitempty"`
+	MaxLength int `json:"max_length,omitempty"`
+
+	// MaxTokenBytes bounds the raw token as read from its source, before any
+	// trimming, splitting or decoding, so that oversized values are rejected
+	// without further work, even when negated. Defaults to 8192; a negative
+	// value disables the limit.
+	MaxTokenBytes int `json:"max_token_bytes,omitempty"`
+
+	// DecodeBase64 base64-decodes the token before it is checked. Standard and
+	// URL-safe alphabets are accepted, with or without padding; a token that
+	// does not decode never matches, even when negated.
+	DecodeBase64 bool `json:"decode_base64,omitempty"`
+
+	// ConstantTime compares prefixes with crypto/subtle so the response time does
+	// not reveal how many leading bytes were correct. Every configured prefix is
+	// checked on each request, which is slower than the short-circuiting default.
+	ConstantTime bool `json:"constant_time,omitempty"`
+
+	// CaseInsensitivePrefix compares prefixes ignoring case. This costs an extra
+	// lowercasing of the token on every request.
+	CaseInsensitivePrefix bool `json:"case_insensitive_prefix,omitempty"`
+
+	// Tokens lists exact token values that are accepted. An entry of the form
+	// "sha256:<hex>" is the SHA-256 digest of an accepted token instead, so the
+	// token itself need not appear in the config; digests are always compared
+	// in constant time.
+	Tokens []string `json:"tokens,omitempty"`
+
+	// TokensMode defines how Tokens and Prefix combine when both are set:
+	// "any" (default) accepts a listed token or a prefixed one, "all" requires
+	// the token to be listed and to have one of the prefixes.
+	TokensMode string `json:"tokens_mode,omitempty"`
+
+	// Suffix, if set, is additionally required at the end of the token.
+	Suffix string `json:"tokensuffix,omitempty"`
+
+	// JWT, if set, requires the token to be a valid JSON Web Token.
+	JWT *JWTConfig `json:"jwt,omitempty"`
+
+	// UnverifiedClaimMatch enables UnverifiedAudience. It is required as an
+	// explicit acknowledgment that the claim is read without verifying the
+	// signature: anyone can forge such a token, so it does not authenticate
+	// the request and only suits routing where the token is verified later.
+	UnverifiedClaimMatch bool `json:"unverified_claim_match,omitempty"`
+
+	// UnverifiedAudience requires the token to be a JWT whose "aud" claim,
+	// decoded without any verification, equals or contains one of these
+	// values. Tokens that are not well-formed JWTs are rejected.
+	UnverifiedAudience []string `json:"unverified_audience,omitempty"`
+
+	// Expiry, if set, requires the token to embed an unexpired Unix time, a
+	// cheaper alternative to JWT for custom token formats.
+	Expiry *ExpiryConfig `json:"expiry,omitempty"`
+
+	// Allowlist, if set, requires a remote allowlist service to accept the
+	// token. It is checked last, once every other criterion has passed, and
+	// its answers are cached.
+	Allowlist *AllowlistConfig `json:"allowlist,omitempty"`
+
+	// BloomFilterFile is a bloom filter of accepted tokens, for allowlists too
+	// large to hold as strings. Tokens not in the filter are rejected, but a
+	// small fraction of the others, the false positive rate chosen when the
+	// filter was built, is accepted as well; combine it with the Allowlist to
+	// confirm the positives. The filter is read at provisioning; build it with
+	// the matchtoken-bloom command or WriteBloomFilter, which documents the
+	// file format.
+	BloomFilterFile string `json:"bloom_filter_file,omitempty"`
+
+	// TokenRegex, if set, is a regular expression the token must match.
+	TokenRegex string `json:"token_regex,omitempty"`
+
+	// HMACSecret, if set, requires tokens of the form "<payload>.<hex-hmac>"
+	// whose signature is the HMAC of the payload under this secret, computed
+	// with HMACAlgo: sha256 (default), sha384 or sha512.
+	HMACSecret string `json:"hmac_secret,omitempty"`
+	HMACAlgo   string `json:"hmac_algo,omitempty"`
+
+	// ChecksumMode, if set, rejects tokens failing a checksum, catching
+	// mistyped or truncated keys: "mod10" applies the Luhn check to the digits
+	// ending the token, such as "key_79927398713", and "crc32" requires the
+	// token to end with the CRC-32 of the rest of it as 8 hex digits. The
+	// checksum is not a token criterion on its own, as anyone can compute it.
+	ChecksumMode string `json:"checksum_mode,omitempty"`
+
+	// Negate inverts the token condition: requests whose token does not satisfy
+	// the prefixes/tokens match, including requests carrying no token at all.
+	// The host condition is not inverted.
+	Negate bool `json:"negate,omitempty"`
+
+	// MatchNoToken makes the token condition pass only for requests carrying
+	// no token in any configured source, for anonymous-only routes. The token
+	// criteria are then unused, and the host condition still applies.
+	MatchNoToken bool `json:"match_no_token,omitempty"`
+
+	// SetHeaderOnMatch, if set, is a request header set to "true" when the
+	// matcher matches and removed when it does not, so that a client can not
+	// forge it on requests the matcher evaluates. Handlers such as
+	// reverse_proxy then forward it to the upstream. Matchers do not run on
+	// every request: when an earlier matcher of the same set fails, or the
+	// route is not reached, the header sent by the client is left untouched,
+	// so strip it first with "request_header -<name>" where that matters.
+	// The vars set on a match, such as {http.vars.matchToken.matched_host},
+	// are an alternative for the header directive.
+	SetHeaderOnMatch string `json:"set_header_on_match,omitempty"`
+
+	// MetricsEnabled counts match outcomes in the caddy_http_matchtoken_results_total
+	// Prometheus counter, labeled by result: match, no_token, bad_token,
+	// token_present, token_conflict, tls_miss, proto_miss, time_miss,
+	// method_miss, header_miss, query_miss, port_miss, path_miss, remote_miss
+	// or host_miss.
+	MetricsEnabled bool `json:"metrics,omitempty"`
+
+	// LogRejectedHosts logs, at info level, requests whose token passed but
+	// whose host was not accepted, which often means a leaked token is being
+	// tried on other hosts. The entry has the host, the client address and
+	// the token fingerprint, never the token.
+	LogRejectedHosts bool `json:"log_rejected_hosts,omitempty"`
+
+	// RejectedHostsLogRate is the maximum number of rejected hosts logged per
+	// second; the others are dropped, so an attack can not flood the logs.
+	// Defaults to 10.
+	RejectedHostsLogRate int `json:"rejected_hosts_log_rate,omitempty"`
+
+	// ReloadInterval, if set, is how often HostFile and PrefixFile are checked
+	// for changes; a modified file is re-read without reloading the Caddy config.
+	ReloadInterval caddy.Duration `json:"reload_interval,omitempty"`
+
+	// DecisionCacheSize, if set, caches the outcome of the token and host
+	// conditions for up to this many combinations of token, token source and
+	// host, evicting the least recently used one, so that recurring tokens do
+	// not repeat the prefix, regex, JWT or host work. The other request
+	// conditions, such as Methods or RemoteRanges, are still checked on every
+	// request. Cached outcomes are dropped when HostFile or PrefixFile is
+	// reloaded; a token that expires, or whose JWKS key is rotated out, may
+	// still be accepted for up to DecisionCacheTTL. It can not be used with
+	// options depending on the rest of the request: PrefixTemplate, prefixes
+	// with request placeholders, StrictSingleSource, ReadBasicAuthPassword and
+	// Allowlist, and it is bypassed while host entries have placeholders.
+	DecisionCacheSize int `json:"decision_cache_size,omitempty"`
+
+	// DecisionCacheTTL is how long a cached outcome is reused. Defaults to 10s.
+	DecisionCacheTTL caddy.Duration `json:"decision_cache_ttl,omitempty"`
+
+	logger          *zap.Logger
+	rejectedLogger  *zap.Logger // sampled, with LogRejectedHosts
+	headerNames     []string
+	cookieNames     []string
+	sources         []string
+	prefixTemplates []string
+	prefixes        []string
+	remoteRanges    []netip.Prefix
+	trustedRanges   []netip.Prefix
+	tokenRegexp     *regexp.Regexp
+	plainTokens     []string
+	tokenHashes     [][]byte
+	hmacHash        func() hash.Hash
+	checksumValid   func(token string) bool
+	bloom           *bloomFilter
+	timeWindows     []timeWindow
+	location        *time.Location
+	clock           func() time.Time // time.Now, replaceable in tests
+	staticHosts     []string
+	hostSet         *hostSet
+	reloadMu        *sync.RWMutex // guards hostSet and prefixes
+	hostFileMod     time.Time
+	prefixFileMod   time.Time
+	stopReload      chan struct{}
+	reloadDone      chan struct{}
+	bypassHosts     *hostSet
+	rules           []*MatchToken
+	hostRules       []*MatchToken // from HostPrefixes
+	parent          *MatchToken   // of a rule, whose excluded hosts it shares
+	implicitRule    bool
+	decisions       *lruCache[decision]
+}
+
+func init() {
+	caddy.RegisterModule(MatchToken{})
+}
+
+// Provision sets up the matcher. The errors it returns are *ProvisionError
+// values telling the kind of mistake in the configuration.
+func (m *MatchToken) Provision(ctx caddy.Context) error {
+	if err := m.provision(ctx.Logger()); err != nil {
+		return asProvisionError(err)
+	}
+	return nil
+}
+
+// NewMatchToken returns a matcher accepting tokens with prefix on hosts,
+// provisioned and validated as from a Caddy config, for use outside of one,
+// such as in routes built in Go. It logs to Caddy's default logger. Call
+// Cleanup when done with it.
+func NewMatchToken(prefix string, hosts ...string) (*MatchToken, error) {
+	m := &MatchToken{Prefix: []string{prefix}, Host: hosts}
+	if err := m.provision(caddy.Log()); err != nil {
+		return nil, asProvisionError(err)
+	}
+	if err := m.Validate(); err != nil {
+		m.Cleanup()
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *MatchToken) provision(logger *zap.Logger) error {
+	m.logger = logger
+	if m.MetricsEnabled {
+		matchTokenMetrics.init.Do(initMatchTokenMetrics)
+	}
+	if m.RejectedHostsLogRate < 0 {
+		return fmt.Errorf("rejected_hosts_log_rate must not be negative: %d", m.RejectedHostsLogRate)
+	}
+	if m.LogRejectedHosts {
+		if m.RejectedHostsLogRate == 0 {
+			m.RejectedHostsLogRate = 10
+		}
+		m.rejectedLogger = m.logger.WithOptions(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+			return zapcore.NewSamplerWithOptions(core, time.Second, m.RejectedHostsLogRate, 0)
+		}))
+	}
+	if m.HeaderName == "" && len(m.HeaderNames) == 0 {
+		m.HeaderName = "token"
+	}
+	if m.HeaderName != "" {
+		m.HeaderName = http.CanonicalHeaderKey(m.HeaderName)
+		m.headerNames = append(m.headerNames, m.HeaderName)
+	}
+	for _, name := range m.HeaderNames {
+		m.headerNames = append(m.headerNames, http.CanonicalHeaderKey(name))
+	}
+	if m.CookieName == "" && len(m.CookieNames) == 0 {
+		m.CookieName = "token"
+	}
+	if m.CookieName != "" {
+		m.cookieNames = append(m.cookieNames, m.CookieName)
+	}
+	m.cookieNames = append(m.cookieNames, m.CookieNames...)
+	if err := m.provisionSources(); err != nil {
+		return err
+	}
+	switch m.TokensMode {
+	case "", "any", "all":
+	default:
+		return fmt.Errorf("unrecognized tokens_mode '%s'", m.TokensMode)
+	}
+	switch m.MatchMode {
+	case "", "prefix", "suffix", "contains", "exact":
+	default:
+		return fmt.Errorf("unrecognized match_mode '%s'", m.MatchMode)
+	}
+	if m.RequireSeparatorAfterPrefix != "" {
+		if m.MatchMode != "" && m.MatchMode != "prefix" {
+			return fmt.Errorf("prefix_separator requires match_mode prefix")
+		}
+		if m.CaseInsensitivePrefix {
+			m.RequireSeparatorAfterPrefix = strings.ToLower(m.RequireSeparatorAfterPrefix)
+		}
+	}
+	if m.UseTLSSNI && m.TrustForwardedHost {
+		return fmt.Errorf("use_tls_sni and trust_forwarded_host can not be combined")
+	}
+	switch m.HostMode {
+	case "", "exact", "suffix":
+	default:
+		return fmt.Errorf("unrecognized host_mode '%s'", m.HostMode)
+	}
+	switch m.ExactHostLookup {
+	case "", "binary", "map", "compact":
+	default:
+		return fmt.Errorf("unrecognized exact_host_lookup '%s'", m.ExactHostLookup)
+	}
+	if err := m.provisionPrefixes(); err != nil {
+		return err
+	}
+	if err := m.provisionEnvPrefixes(); err != nil {
+		return err
+	}
+	if m.MaxTokenBytes == 0 {
+		m.MaxTokenBytes = 8192
+	}
+	if m.MinLength < 0 || m.MaxLength < 0 || (m.MaxLength > 0 && m.MinLength > m.MaxLength) {
+		return fmt.Errorf("invalid token length bounds: min_length %d, max_length %d", m.MinLength, m.MaxLength)
+	}
+	remoteRanges, err := parseRanges(m.RemoteRanges)
+	if err != nil {
+		return fmt.Errorf("remote_ranges: %v", err)
+	}
+	m.remoteRanges = remoteRanges
+	if m.trustedRanges, err = parseRanges(m.TrustedNoTokenRanges); err != nil {
+		return fmt.Errorf("trusted_no_token_ranges: %v", err)
+	}
+	if err := m.provisionTimeWindows(); err != nil {
+		return err
+	}
+	if m.MinProtoMajor < 0 || m.MinProtoMajor > 3 {
+		return fmt.Errorf("min_proto_major must be between 0 and 3: %d", m.MinProtoMajor)
+	}
+	if m.LargeThreshold < 0 {
+		return fmt.Errorf("large_threshold must not be negative: %d", m.LargeThreshold)
+	}
+	if m.PathTokenIndex != nil && *m.PathTokenIndex < 0 {
+		return fmt.Errorf("path_token_index must not be negative: %d", *m.PathTokenIndex)
+	}
+	for i, prefix := range m.PathPrefixes {
+		if !strings.HasPrefix(prefix, "/") {
+			return fmt.Errorf("path prefix '%s' must start with /", prefix)
+		}
+		m.PathPrefixes[i] = strings.TrimSuffix(prefix, "/")
+	}
+	for i, method := range m.Methods {
+		m.Methods[i] = strings.ToUpper(method)
+	}
+	if m.SetHeaderOnMatch != "" && !httpguts.ValidHeaderFieldName(m.SetHeaderOnMatch) {
+		return fmt.Errorf("invalid set_header_on_match header name '%s'", m.SetHeaderOnMatch)
+	}
+	for _, port := range m.Ports {
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return fmt.Errorf("invalid port '%s'", port)
+		}
+	}
+	if m.TokenRegex != "" {
+		re, err := regexp.Compile(m.TokenRegex)
+		if err != nil {
+			return fmt.Errorf("compiling token_regex '%s': %v", m.TokenRegex, err)
+		}
+		m.tokenRegexp = re
+	}
+	if err := m.provisionHMAC(); err != nil {
+		return err
+	}
+	if err := m.provisionChecksum(); err != nil {
+		return err
+	}
+	if m.JWT != nil {
+		if err := m.JWT.provision(m.logger); err != nil {
+			return err
+		}
+	}
+	if m.UnverifiedClaimMatch != (len(m.UnverifiedAudience) > 0) {
+		return fmt.Errorf("unverified_claim_match and unverified_audience must be set together")
+	}
+	if m.UnverifiedClaimMatch {
+		m.logger.Warn("unverified_claim_match is set: the aud claim is read without verifying the token signature, so it does not authenticate requests")
+	}
+	if m.Expiry != nil {
+		if err := m.Expiry.provision(); err != nil {
+			return err
+		}
+	}
+	if m.Allowlist != nil {
+		if err := m.Allowlist.provision(m.logger); err != nil {
+			return err
+		}
+	}
+	if m.BloomFilterFile != "" {
+		if m.bloom, err = loadBloomFilter(m.BloomFilterFile); err != nil {
+			return err
+		}
+	}
+	if err := m.provisionTokens(); err != nil {
+		return err
+	}
+
+	m.staticHosts = m.Host
+	if m.HostFile != "" {
+		if info, err := os.Stat(m.HostFile); err == nil {
+			m.hostFileMod = info.ModTime()
+		}
+	}
+	set, err := m.loadHosts()
+	if err != nil {
+		return err
+	}
+	m.hostSet = set
+	if len(m.BypassHosts) > 0 {
+		if m.bypassHosts, err = m.prepareHosts(m.BypassHosts); err != nil {
+			return fmt.Errorf("bypass_hosts: %w", err)
+		}
+	}
+	if m.PrefixFile != "" {
+		if info, err := os.Stat(m.PrefixFile); err == nil {
+			m.prefixFileMod = info.ModTime()
+		}
+	}
+	prefixes, err := m.loadPrefixes()
+	if err != nil {
+		return err
+	}
+	m.prefixes = prefixes
+	if err := m.provisionRules(); err != nil {
+		return err
+	}
+	m.reloadMu = new(sync.RWMutex)
+	if m.DecisionCacheSize < 0 {
+		return fmt.Errorf("decision_cache_size must not be negative")
+	}
+	if m.DecisionCacheSize > 0 {
+		if err := m.provisionDecisionCache(); err != nil {
+			return err
+		}
+	}
+
+	if (m.HostFile != "" || m.PrefixFile != "") && m.ReloadInterval > 0 {
+		m.stopReload = make(chan struct{})
+		m.reloadDone = make(chan struct{})
+		go func(stop <-chan struct{}, done chan<- struct{}) {
+			defer close(done)
+			m.watchFiles(time.Duration(m.ReloadInterval), stop)
+		}(m.stopReload, m.reloadDone)
+	}
+	return nil
+}
+
+// hostSet is a host list prepared for matching. It is replaced as a whole
+// when the host file is reloaded.
+type hostSet struct {
+	include hostList
+	exclude hostList
+}
+
+// hostList holds host names and patterns, partitioned so exact names can be
+// looked up without scanning the fuzzy ones. Wildcards are pre-split; entries
+// with placeholders can only be resolved per request. any is set by a
+// whole-host "*" entry.
+type hostList struct {
+	exact        []string
+	exactSet     map[string]struct{} // with ExactHostLookup "map"
+	exactTable   *hostTable          // with ExactHostLookup "compact"
+	wildcards    []hostPattern
+	leftmost     map[string]string // "*.<suffix>" entries by suffix
+	placeholders []string
+	regexps      []*regexp.Regexp
+	any          bool
+}
+
+// hostPattern is a wildcard host split into labels in advance. A leading
+// "**" label is kept apart as anyDepth, leaving the remaining labels as the
+// suffix to match.
+type hostPattern struct {
+	host     string
+	labels   []string
+	globs    []bool // labels with glob syntax, other than a lone "*"
+	anyDepth bool
+	port     string // "" if the pattern has no ":port" suffix
+}
+
+func newHostPattern(host string) hostPattern {
+	pattern := hostPattern{host: host}
+	name := host
+	if i := strings.LastIndexByte(host, ':'); i >= 0 {
+		// patterns are never IPv6 addresses, so the colon starts a port
+		name, pattern.port = host[:i], host[i+1:]
+	}
+	rest, anyDepth := strings.CutPrefix(name, "**.")
+	pattern.labels = strings.Split(rest, ".")
+	pattern.anyDepth = anyDepth
+	pattern.globs = make([]bool, len(pattern.labels))
+	for i, label := range pattern.labels {
+		pattern.globs[i] = label != "*" && isGlob(label)
+	}
+	return pattern
+}
+
+// leftmostSuffix returns the part after "*." of a pattern whose only
+// wildcard is a leading "*" label, such as "*.example.com", the most common
+// kind. Such patterns are looked up by suffix instead of label by label.
+func (p hostPattern) leftmostSuffix() (string, bool) {
+	if p.anyDepth || p.port != "" || len(p.labels) < 2 || p.labels[0] != "*" {
+		return "", false
+	}
+	for _, label := range p.labels[1:] {
+		if label == "" || isGlob(label) {
+			return "", false
+		}
+	}
+	return strings.Join(p.labels[1:], "."), true
+}
+
+// validate checks the syntax of the glob labels and of the port.
+func (p hostPattern) validate() error {
+	if i := strings.LastIndexByte(p.host, ':'); i >= 0 {
+		if n, err := strconv.Atoi(p.port); err != nil || n < 1 || n > 65535 {
+			return fmt.Errorf("invalid port '%s'", p.port)
+		}
+	}
+	for i, label := range p.labels {
+		if p.globs[i] {
+			if _, err := path.Match(label, ""); err != nil {
+				return fmt.Errorf("label '%s': %v", label, err)
+			}
+		}
+	}
+	return nil
+}
+
+// isGlob reports whether s has glob syntax: "*", "?", a character class
+// such as "[0-9]", or a backslash escaping a literal metacharacter.
+func isGlob(s string) bool {
+	return strings.ContainsAny(s, `*?[\`)
+}
+
+// isIPLiteral reports whether host is an IP address, optionally in brackets
+// and followed by a port, such as "[::1]:8443".
+func isIPLiteral(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	_, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"))
+	return err == nil
+}
+
+// loadHosts returns the configured hosts merged with those in HostFile,
+// ready to be used for matching.
+func (m *MatchToken) loadHosts() (*hostSet, error) {
+	hosts := append([]string(nil), m.staticHosts...)
+	if m.HostFile != "" {
+		fileHosts, err := readHostFile(m.HostFile)
+		if err != nil {
+			return nil, err
+		}
+		hosts = append(hosts, fileHosts...)
+	}
+	set, err := m.prepareHosts(hosts)
+	if err != nil {
+		return nil, err
+	}
+	if m.MatchAnyHost {
+		set.include.any = true
+	}
+	if os.Getenv(debugHostsEnv) != "" {
+		m.logHostSet(set)
+	}
+	return set, nil
+}
+
+// debugHostsEnv is the environment variable that, when set to any non-empty
+// value, makes the matcher log at debug level how its hosts were partitioned
+// each time they are loaded, to help find out why a host does not match.
+const debugHostsEnv = "MATCHTOKEN_DEBUG_HOSTS"
+
+// logHostSet logs the number of entries of each kind in set and how the
+// exact hosts are looked up.
+func (m *MatchToken) logHostSet(set *hostSet) {
+	for _, l := range []struct {
+		name string
+		list *hostList
+	}{{"include", &set.include}, {"exclude", &set.exclude}} {
+		exact, lookup := len(l.list.exact), "linear"
+		switch {
+		case l.list.exactSet != nil:
+			exact, lookup = len(l.list.exactSet), "map"
+		case l.list.exactTable != nil:
+			exact, lookup = l.list.exactTable.len(), "compact"
+		case m.large(l.list.exact):
+			lookup = "binary"
+		}
+		m.logger.Debug("host partitioning",
+			zap.String("list", l.name),
+			zap.Int("exact", exact),
+			zap.String("exact_lookup", lookup),
+			zap.Int("leftmost_wildcards", len(l.list.leftmost)),
+			zap.Int("wildcards", len(l.list.wildcards)),
+			zap.Int("placeholders", len(l.list.placeholders)),
+			zap.Int("regexps", len(l.list.regexps)),
+			zap.Bool("any", l.list.any),
+		)
+	}
+}
+
+// prepareHosts normalizes the hosts, rejecting duplicates, compiles regular
+// expressions and separates the negated entries (those starting with "!") from
+// the positive ones.
+func (m *MatchToken) prepareHosts(hosts []string) (*hostSet, error) {
+	set := new(hostSet)
+
+	// check for duplicates; they are nonsensical and reduce efficiency
+	// (we could just remove them, but the user should know their config is erroneous)
+	seen := make(map[string]int, len(hosts))
+	for i, host := range hosts {
+		negated := strings.HasPrefix(host, "!")
+		list := &set.include
+		if negated {
+			list = &set.exclude
+		}
+
+		if strings.TrimPrefix(host, "!") == "*" {
+			list.any = true
+			continue
+		}
+		if pattern, ok := strings.CutPrefix(strings.TrimPrefix(host, "!"), "~"); ok {
+			if firstI, ok := seen[host]; ok {
+				if m.DedupeHosts {
+					m.logger.Warn("ignoring repeated host", zap.Int("first_index", firstI), zap.Int("index", i), zap.String("host", host))
+					continue
+				}
+				return nil, categorized(CategoryDuplicateHost, fmt.Errorf("host at index %d is repeated at index %d: %s", firstI, i, host))
+			}
+			seen[host] = i
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, categorized(CategoryInvalidHost, fmt.Errorf("compiling host pattern '%s': %v", pattern, err))
+			}
+			list.regexps = append(list.regexps, re)
+			continue
+		}
+
+		asciiHost := strings.TrimPrefix(host, "!")
+		if !m.CaseSensitiveHost && !strings.Contains(asciiHost, "{") {
+			// before the conversion, as upper and lower case letters are
+			// encoded differently; placeholder names are case-sensitive, so
+			// entries with them are lowercased once expanded
+			asciiHost = strings.ToLower(asciiHost)
+		}
+		asciiHost, err := hostToASCII(asciiHost)
+		if err != nil {
+			return nil, categorized(CategoryInvalidHost, fmt.Errorf("converting hostname '%s' to ASCII: %v", host, err))
+		}
+		asciiHost = strings.TrimSuffix(asciiHost, ".")
+		// brackets of IPv6 addresses are not glob character classes
+		ipLiteral := isIPLiteral(asciiHost)
+		if ipLiteral && !m.MatchHostWithPort {
+			// compared like the request host, without brackets
+			if h, port := splitRequestHost(asciiHost); port == "" {
+				asciiHost = h
+			}
+		}
+		normalizedHost := asciiHost
+		if negated {
+			normalizedHost = "!" + normalizedHost
+		}
+		if firstI, ok := seen[normalizedHost]; ok {
+			if m.DedupeHosts {
+				m.logger.Warn("ignoring repeated host", zap.Int("first_index", firstI), zap.Int("index", i), zap.String("host", host))
+				continue
+			}
+			return nil, categorized(CategoryDuplicateHost, fmt.Errorf("host at index %d is repeated at index %d: %s", firstI, i, host))
+		}
+		seen[normalizedHost] = i
+		switch {
+		case strings.Contains(asciiHost, "{"):
+			list.placeholders = append(list.placeholders, asciiHost)
+		case !ipLiteral && isGlob(asciiHost):
+			pattern := newHostPattern(asciiHost)
+			if err := pattern.validate(); err != nil {
+				return nil, categorized(CategoryInvalidHost, fmt.Errorf("host pattern '%s': %v", host, err))
+			}
+			if pattern.port != "" && !m.MatchHostWithPort {
+				return nil, categorized(CategoryInvalidHost, fmt.Errorf("host pattern '%s' has a port, which requires match_host_with_port", host))
+			}
+			if suffix, ok := pattern.leftmostSuffix(); ok {
+				if list.leftmost == nil {
+					list.leftmost = make(map[string]string)
+				}
+				list.leftmost[suffix] = asciiHost
+				break
+			}
+			list.wildcards = append(list.wildcards, pattern)
+		default:
+			if _, _, err := net.SplitHostPort(asciiHost); err == nil && !m.MatchHostWithPort {
+				return nil, categorized(CategoryInvalidHost, fmt.Errorf("host '%s' has a port, which requires match_host_with_port", host))
+			}
+			list.exact = append(list.exact, asciiHost)
+		}
+	}
+
+	// sorted so exact matches can be found with binary search, which we have
+	// seen from experience is the most common kind of value in large lists
+	sort.Strings(set.include.exact)
+	sort.Strings(set.exclude.exact)
+	for _, list := range []*hostList{&set.include, &set.exclude} {
+		switch m.ExactHostLookup {
+		case "map":
+			list.exactSet = newStringSet(list.exact)
+			list.exact = nil
+		case "compact":
+			table, err := newHostTable(list.exact)
+			if err != nil {
+				return nil, err
+			}
+			list.exactTable = table
+			list.exact = nil
+		}
+	}
+	return set, nil
+}
+
+func newStringSet(values []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(values))
+	for _, v := range values {
+		set[v] = struct{}{}
+	}
+	return set
+}
+
+// hosts returns the current host set, which may be swapped by a reload.
+func (m *MatchToken) hosts() *hostSet {
+	if m.reloadMu == nil {
+		return m.hostSet
+	}
+	m.reloadMu.RLock()
+	defer m.reloadMu.RUnlock()
+	return m.hostSet
+}
+
+// Cleanup stops the background goroutines started by Provision and waits for
+// them to exit. Metrics are not unregistered: the counters are shared by all
+// matcher instances and survive config reloads.
+func (m *MatchToken) Cleanup() error {
+	if m.stopReload != nil {
+		close(m.stopReload)
+		<-m.reloadDone
+		m.stopReload = nil
+	}
+	if m.JWT != nil {
+		m.JWT.cleanup()
+	}
+	return nil
+}
+
+// Validate checks for configurations that can not behave as intended.
+func (m *MatchToken) Validate() error {
+	if !m.implicitRule {
+		// only Rules are used, and their prefix and hosts are required
+		if !m.hostPrefixFallback() && (len(m.Prefix) > 0 || m.PrefixFile != "" || m.PrefixEnv != "" || m.PrefixTemplate != "") {
+			m.logger.Warn("rules are set without host, host_file or match_any_host; ignoring tokenprefix, prefix_file, prefix_env and prefix_template",
+				zap.Strings("tokenprefix", m.Prefix))
+		}
+		return nil
+	}
+	set := m.hosts()
+	if set.include.empty() && !m.AllowEmptyHosts && m.requireHostMatch() {
+		return fmt.Errorf("no hosts configured; the matcher would never match (set allow_empty_hosts if intended, or require_host_match false for token-only matching)")
+	}
+	if m.MatchNoToken && m.Negate {
+		return fmt.Errorf("match_no_token and negate can not be combined")
+	}
+	if !m.MatchNoToken && !m.hasTokenCriteria() {
+		return fmt.Errorf("no token criteria configured; set tokenprefix, tokens or another token option")
+	}
+	if m.PrefixTemplate != "" && len(m.Prefix) > 0 {
+		m.logger.Warn("prefix_template is set; ignoring tokenprefix", zap.Strings("tokenprefix", m.Prefix))
+	}
+	for i, prefix := range m.Prefix {
+		if prefix == "" && !m.AllowEmptyPrefix {
+			return fmt.Errorf("token prefix at index %d is empty and would accept any token; set allow_empty_prefix if intended", i)
+		}
+	}
+	return nil
+}
+
+// CaddyModule returns the Caddy module information.
+func (MatchToken) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.matchers.matchToken",
+		New: func() caddy.Module { return new(MatchToken) },
+	}
+}
+
+/**
+ * Verifico que el token que me mandan tenga el prefijo especificado, si fuera el caso, entonces valido el host. Las 2 condiciones se deben de cumplir para regresar verdadero
+ * Si coincide, deja en {http.matchers.matchToken.matched_host} la entrada de host que coincidio
+ * y en {http.matchers.matchToken.token_source} de donde se leyo el token (header, cookie, query...)
+ * Tambien deja la entrada de host en {http.vars.matchToken.matched_host}, junto con el prefijo en {http.vars.matchToken.matched_prefix}
+ * Con SetHeaderOnMatch pone ese header del request en "true" si coincide, y lo quita si no
+ */
+func (m *MatchToken) Match(req *http.Request) bool {
+	out := m.evaluate(req)
+	if m.MetricsEnabled {
+		matchTokenMetrics.results.WithLabelValues(out.result).Inc()
+	}
+	if c := m.logger.Check(zapcore.DebugLevel, "matchToken decision"); c != nil {
+		c.Write(
+			zap.String("result", out.result),
+			zap.String("host", out.host),
+			zap.String("token_fingerprint", tokenFingerprint(out.token)),
+		)
+	}
+	if m.rejectedLogger != nil && out.result == resultHostMiss && out.token != "" && !m.trustedClient(req) {
+		m.rejectedLogger.Info("token passed on a rejected host",
+			zap.String("host", out.host),
+			zap.String("remote_addr", req.RemoteAddr),
+			zap.String("token_fingerprint", tokenFingerprint(out.token)),
+		)
+	}
+	setFailureVar(req, out.result)
+	setMatchedVars(req, out)
+	if m.SetHeaderOnMatch != "" {
+		if out.result == resultMatch {
+			req.Header.Set(m.SetHeaderOnMatch, "true")
+		} else {
+			req.Header.Del(m.SetHeaderOnMatch)
+		}
+	}
+	return out.result == resultMatch
+}
+
+// failureVar is the request variable telling why the last evaluation of a
+// matchToken matcher failed: "token" when the token is missing, not accepted
+// or present despite MatchNoToken, "host" when the host is not accepted, or
+// "request" when the TLS, protocol, time window, method, header, query, port,
+// path or client address condition failed. It is removed when the matcher matches. Handlers
+// following a failed match can use it to answer differently, for instance:
+//
+//	@authorized matchToken abc example.com
+//	handle @authorized {
+//	    reverse_proxy backend:8080
+//	}
+//	@badtoken vars {http.vars.matchToken.failure} token
+//	respond @badtoken 401
+//	respond 404
+const failureVar = "matchToken.failure"
+
+// setFailureVar records the kind of failure of result in failureVar.
+func setFailureVar(req *http.Request, result string) {
+	var failure string
+	switch result {
+	case resultMatch:
+		if caddyhttp.GetVar(req.Context(), failureVar) != nil {
+			caddyhttp.SetVar(req.Context(), failureVar, nil)
+		}
+		return
+	case resultNoToken, resultBadToken, resultTokenPresent, resultTokenConflict:
+		failure = "token"
+	case resultHostMiss:
+		failure = "host"
+	default:
+		failure = "request"
+	}
+	caddyhttp.SetVar(req.Context(), failureVar, failure)
+}
+
+// matchedHostVar and matchedPrefixVar are the request variables holding, after
+// a match, the Host entry and the prefix that were satisfied, for use in log
+// formats as {http.vars.matchToken.matched_host}. Only configured patterns are
+// exposed: the prefix is empty when the token was accepted by other criteria,
+// such as Tokens, and with MatchMode "exact", where it equals the token. Both
+// are removed when the matcher does not match.
+const (
+	matchedHostVar   = "matchToken.matched_host"
+	matchedPrefixVar = "matchToken.matched_prefix"
+)
+
+// setMatchedVars records the patterns satisfied by out in matchedHostVar and
+// matchedPrefixVar.
+func setMatchedVars(req *http.Request, out matchOutcome) {
+	if out.result != resultMatch {
+		for _, key := range []string{matchedHostVar, matchedPrefixVar} {
+			if caddyhttp.GetVar(req.Context(), key) != nil {
+				caddyhttp.SetVar(req.Context(), key, nil)
+			}
+		}
+		return
+	}
+	caddyhttp.SetVar(req.Context(), matchedHostVar, out.matchedHost)
+	caddyhttp.SetVar(req.Context(), matchedPrefixVar, out.matchedPrefix)
+}
+
+// matchOutcome describes how a request was evaluated.
+type matchOutcome struct {
+	result        string
+	host          string
+	token         string // never log it; use tokenFingerprint
+	matchedHost   string
+	matchedPrefix string
+}
+
+// Outcomes of a match: resultMatch or the reason the request did not match.
+const (
+	resultMatch         = "match"
+	resultNoToken       = "no_token"
+	resultBadToken      = "bad_token"
+	resultTokenPresent  = "token_present"
+	resultTokenConflict = "token_conflict"
+	resultTLSMiss       = "tls_miss"
+	resultProtoMiss     = "proto_miss"
+	resultTimeMiss      = "time_miss"
+	resultMethodMiss    = "method_miss"
+	resultHeaderMiss    = "header_miss"
+	resultQueryMiss     = "query_miss"
+	resultPortMiss      = "port_miss"
+	resultPathMiss      = "path_miss"
+	resultRemoteMiss    = "remote_miss"
+	resultHostMiss      = "host_miss"
+)
+
+// match evaluates the request and returns its outcome.
+func (m *MatchToken) match(req *http.Request) matchOutcome {
+	token, source, ok := m.extractToken(req)
+	out := matchOutcome{host: req.Host, token: token}
+	repl, hasRepl := req.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if !hasRepl {
+		// not running behind Caddy's HTTP server, e.g. in tests
+		repl = caddy.NewReplacer()
+	}
+	/********************************************************************************************************/
+	reqHost, reqPort := m.hostAndPort(req)
+	out.host = reqHost
+
+	d := m.cachedDecide(req, token, source, ok, reqHost, repl)
+	if d.tokenResult != "" {
+		out.result = d.tokenResult
+		return out
+	}
+
+	if m.RequireTLS && req.TLS == nil {
+		out.result = resultTLSMiss
+		return out
+	}
+	if req.ProtoMajor < m.MinProtoMajor {
+		out.result = resultProtoMiss
+		return out
+	}
+	if len(m.timeWindows) > 0 && !m.inTimeWindow() {
+		out.result = resultTimeMiss
+		return out
+	}
+	if len(m.Methods) > 0 && !m.hasMethod(req.Method) {
+		out.result = resultMethodMiss
+		return out
+	}
+	if len(m.HeaderMatches) > 0 && !m.headersMatch(req) {
+		out.result = resultHeaderMiss
+		return out
+	}
+	if len(m.QueryMatches) > 0 && !m.queryMatches(req) {
+		out.result = resultQueryMiss
+		return out
+	}
+	if len(m.Ports) > 0 && !m.hasPort(req, reqPort) {
+		out.result = resultPortMiss
+		return out
+	}
+	if len(m.PathPrefixes) > 0 && !m.hasPathPrefix(req.URL.Path) {
+		out.result = resultPathMiss
+		return out
+	}
+	if len(m.remoteRanges) > 0 {
+		addr, err := clientIP(req)
+		if err != nil || !inRanges(addr, m.remoteRanges) {
+			out.result = resultRemoteMiss
+			return out
+		}
+	}
+
+	if !d.found {
+		out.result = resultHostMiss
+		return out
+	}
+	out.result = resultMatch
+	out.matchedHost = d.host
+	out.matchedPrefix = d.prefix
+	if d.bypass {
+		source = ""
+	}
+	repl.Set("http.matchers.matchToken.matched_host", d.host)
+	repl.Set("http.matchers.matchToken.token_source", source)
+	return out
+}
+
+// decision is the outcome of the token and host conditions, which only
+// depend on the token, its source and the host when the decision cache is
+// used.
+type decision struct {
+	tokenResult string // a failure result, or "" if the token passed
+	bypass      bool   // the host is one of BypassHosts
+	found       bool   // the host condition passed
+	host        string // the host entry that matched
+	prefix      string // the prefix the token satisfied, if reported
+}
+
+// decide evaluates the token and host conditions. With BypassHosts, the
+// token is checked only for the other hosts; for a trusted client, from
+// TrustedNoTokenRanges, it is not checked at all.
+func (m *MatchToken) decide(req *http.Request, token, source string, ok bool, reqHost string, repl *caddy.Replacer, trusted bool) decision {
+	var d decision
+	if m.bypassHosts != nil {
+		d.host, d.bypass = m.matchHostSet(m.bypassHosts, reqHost, repl)
+	}
+	if d.bypass {
+		d.found = true
+		return d
+	}
+	if !trusted {
+		result, accepted := m.checkRequestToken(req, token, source, ok, repl)
+		if result != "" {
+			d.tokenResult = result
+			return d
+		}
+		if accepted != "" && m.MatchMode != "exact" {
+			// with "exact" the prefix is the token itself
+			d.prefix, _ = m.matchedPrefix(accepted, repl)
+		}
+	}
+	d.host, d.found = m.matchedHost(reqHost, repl)
+	if !d.found && !m.requireHostMatch() {
+		d.found = true
+	}
+	return d
+}
+
+// cachedDecide is like decide, but uses the decision cache when enabled.
+func (m *MatchToken) cachedDecide(req *http.Request, token, source string, ok bool, reqHost string, repl *caddy.Replacer) decision {
+	trusted := m.trustedClient(req)
+	if m.decisions == nil || m.hostsHavePlaceholders() {
+		return m.decide(req, token, source, ok, reqHost, repl, trusted)
+	}
+	if ok && m.MaxTokenBytes > 0 && len(token) > m.MaxTokenBytes {
+		// rejected by decide without being hashed nor cached
+		return m.decide(req, token, source, ok, reqHost, repl, trusted)
+	}
+	h := sha256.New()
+	for _, s := range []string{source, token, reqHost} {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+	if trusted {
+		h.Write([]byte{1})
+	}
+	var key [sha256.Size]byte
+	h.Sum(key[:0])
+	now := time.Now()
+	if d, found := m.decisions.get(key, now); found {
+		return d
+	}
+	gen := m.decisions.generation()
+	d := m.decide(req, token, source, ok, reqHost, repl, trusted)
+	m.decisions.putAt(gen, key, d, now.Add(time.Duration(m.DecisionCacheTTL)))
+	return d
+}
+
+// trustedClient reports whether the client address is in TrustedNoTokenRanges.
+func (m *MatchToken) trustedClient(req *http.Request) bool {
+	if len(m.trustedRanges) == 0 {
+		return false
+	}
+	addr, err := clientIP(req)
+	return err == nil && inRanges(addr, m.trustedRanges)
+}
+
+// hostsHavePlaceholders reports whether any host entry, which may come from
+// a reloaded HostFile, is expanded per request.
+func (m *MatchToken) hostsHavePlaceholders() bool {
+	set := m.hosts()
+	if len(set.include.placeholders) > 0 || len(set.exclude.placeholders) > 0 {
+		return true
+	}
+	b := m.bypassHosts
+	return b != nil && (len(b.include.placeholders) > 0 || len(b.exclude.placeholders) > 0)
+}
+
+// provisionDecisionCache validates the decision cache options and creates a
+// cache for the matcher and each rule.
+func (m *MatchToken) provisionDecisionCache() error {
+	if m.DecisionCacheTTL < 0 {
+		return fmt.Errorf("decision_cache_ttl must not be negative")
+	}
+	if m.DecisionCacheTTL == 0 {
+		m.DecisionCacheTTL = caddy.Duration(10 * time.Second)
+	}
+	switch {
+	case m.PrefixTemplate != "" || len(m.prefixTemplates) > 0:
+		return fmt.Errorf("decision_cache_size can not be used with request-dependent prefixes")
+	case m.StrictSingleSource:
+		return fmt.Errorf("decision_cache_size can not be used with strict_single_source")
+	case m.ReadBasicAuthPassword:
+		return fmt.Errorf("decision_cache_size can not be used with read_basic_auth_password")
+	case m.Allowlist != nil:
+		return fmt.Errorf("decision_cache_size can not be used with allowlist, which has its own cache")
+	}
+	rules := slices.Concat(m.hostRules, m.rules)
+	for _, r := range rules {
+		// rule prefixes may have request placeholders too
+		if len(r.prefixTemplates) > 0 {
+			return fmt.Errorf("decision_cache_size can not be used with request-dependent prefixes")
+		}
+	}
+	m.decisions = newLRUCache[decision](m.DecisionCacheSize)
+	for _, r := range rules {
+		// the rules were copied before the TTL got its default
+		r.DecisionCacheTTL = m.DecisionCacheTTL
+		r.decisions = newLRUCache[decision](m.DecisionCacheSize)
+	}
+	return nil
+}
+
+// checkRequestToken applies the token condition to the token extracted from
+// the request, if ok, and returns the result of a failure or "" if it passes,
+// along with the accepted token candidate, if any.
+func (m *MatchToken) checkRequestToken(req *http.Request, token, source string, ok bool, repl *caddy.Replacer) (string, string) {
+	if ok && m.MaxTokenBytes > 0 && len(token) > m.MaxTokenBytes {
+		return resultBadToken, ""
+	}
+	if m.StrictSingleSource && m.conflictingTokens(req) {
+		return resultTokenConflict, ""
+	}
+	if ok && source == tokenSourceBasicAuth {
+		if _, _, valid := m.basicAuthToken(req); !valid {
+			return resultBadToken, ""
+		}
+	}
+	if m.MatchNoToken {
+		if ok {
+			return resultTokenPresent, ""
+		}
+		return "", ""
+	}
+	allowed, accepted := false, ""
+	if ok {
+		var valid bool
+		accepted, allowed, valid = m.acceptToken(token, source == tokenSourceHeader, repl)
+		if !valid {
+			return resultBadToken, ""
+		}
+	}
+	if allowed == m.Negate {
+		if !ok {
+			return resultNoToken, ""
+		}
+		return resultBadToken, ""
+	}
+	return "", accepted
+}
+
+// acceptToken checks an extracted token, split on SplitHeader first when
+// split is set, and reports whether any candidate is allowed, returning the
+// first allowed one as prepared by checkToken. A candidate failing the length bounds makes the whole
+// token invalid. A nil repl expands request placeholders to empty strings.
+func (m *MatchToken) acceptToken(token string, split bool, repl *caddy.Replacer) (accepted string, allowed, valid bool) {
+	if repl == nil {
+		repl = caddy.NewReplacer()
+	}
+	candidates := []string{token}
+	if split && m.SplitHeader != "" {
+		candidates = strings.Split(token, m.SplitHeader)
+		for i := range candidates {
+			candidates[i] = strings.TrimSpace(candidates[i])
+		}
+	}
+	for _, candidate := range candidates {
+		prepared, candidateAllowed, valid := m.checkToken(candidate, repl)
+		if !valid {
+			return "", false, false
+		}
+		if candidateAllowed && !allowed {
+			accepted, allowed = prepared, true
+		}
+	}
+	return accepted, allowed, true
+}
+
+// matchHost reports whether reqHost, without its port unless
+// MatchHostWithPort is set, is included and not excluded by the host list.
+// A nil repl expands request placeholders to empty strings.
+func (m *MatchToken) matchHost(reqHost string, repl *caddy.Replacer) bool {
+	_, ok := m.matchedHost(reqHost, repl)
+	return ok
+}
+
+// matchedHost is like matchHost but also returns the Host entry that
+// included reqHost.
+func (m *MatchToken) matchedHost(reqHost string, repl *caddy.Replacer) (string, bool) {
+	if m.parent != nil && m.parent.excludesHost(reqHost, repl) {
+		return "", false
+	}
+	return m.matchHostSet(m.hosts(), reqHost, repl)
+}
+
+// excludesHost reports whether reqHost is excluded by a negated entry of the
+// host list.
+func (m *MatchToken) excludesHost(reqHost string, repl *caddy.Replacer) bool {
+	if repl == nil {
+		repl = caddy.NewReplacer()
+	}
+	_, excluded := m.matchHostList(&m.hosts().exclude, m.normalizeHost(reqHost), repl)
+	return excluded
+}
+
+// matchHostSet normalizes reqHost and reports whether it is included and not
+// excluded by set, returning the entry that included it.
+func (m *MatchToken) matchHostSet(set *hostSet, reqHost string, repl *caddy.Replacer) (string, bool) {
+	if repl == nil {
+		repl = caddy.NewReplacer()
+	}
+	reqHost = m.normalizeHost(reqHost)
+	if _, excluded := m.matchHostList(&set.exclude, reqHost, repl); excluded {
+		return "", false
+	}
+	return m.matchHostList(&set.include, reqHost, repl)
+}
+
+// matchHostList reports whether reqHost matches any entry of list, and
+// returns the entry that matched.
+func (m *MatchToken) matchHostList(list *hostList, reqHost string, repl *caddy.Replacer) (string, bool) {
+	if list.any {
+		return "*", true
+	}
+	if m.HostMode == "suffix" {
+		// every suffix of the host is looked up, which scales with the host
+		// length rather than with the number of entries
+		for i := 0; i < len(reqHost); i++ {
+			if m.hasExactHost(list, reqHost[i:]) {
+				return reqHost[i:], true
+			}
+		}
+	} else if m.hasExactHost(list, reqHost) {
+		return reqHost, true
+	}
+
+	if len(list.leftmost) > 0 {
+		// a "*" label is non-empty, and what follows it must be an entry
+		if i := strings.IndexByte(reqHost, '.'); i > 0 {
+			if entry, ok := list.leftmost[reqHost[i+1:]]; ok {
+				return entry, true
+			}
+		}
+	}
+
+	// the incoming host is split only once, and only if a pattern needs it
+	var incomingParts []string
+	var incomingPort string
+	if len(list.wildcards) > 0 {
+		incomingParts, incomingPort = m.splitIncomingHost(reqHost)
+	}
+	for _, pattern := range list.wildcards {
+		if m.matchHostPattern(pattern, incomingParts, incomingPort) {
+			return pattern.host, true
+		}
+	}
+
+	for _, tmpl := range list.placeholders {
+		host, ok := expandHost(tmpl, repl)
+		if !ok || host == "" {
+			// a missing value must not match requests without a host
+			continue
+		}
+		// expanded values skipped the normalization done by Provision
+		host = m.normalizeHost(host)
+		if isGlob(host) {
+			if incomingParts == nil {
+				incomingParts, incomingPort = m.splitIncomingHost(reqHost)
+			}
+			if m.matchHostPattern(newHostPattern(host), incomingParts, incomingPort) {
+				return tmpl, true
+			}
+		} else if reqHost == host {
+			return tmpl, true
+		}
+	}
+
+	for _, re := range list.regexps {
+		if re.MatchString(reqHost) {
+			return "~" + re.String(), true
+		}
+	}
+	return "", false
+}
+
+// hasExactHost reports whether host is one of the exact entries of list.
+func (m *MatchToken) hasExactHost(list *hostList, host string) bool {
+	if list.exactSet != nil {
+		_, ok := list.exactSet[host]
+		return ok
+	}
+	if list.exactTable != nil {
+		return list.exactTable.contains(host)
+	}
+	if m.large(list.exact) {
+		// fast path: locate exact match using binary search (about 100-1000x faster for large lists)
+		pos := sort.SearchStrings(list.exact, host)
+		return pos < len(list.exact) && list.exact[pos] == host
+	}
+	for _, entry := range list.exact {
+		if host == entry {
+			return true
+		}
+	}
+	return false
+}
+
+// splitIncomingHost splits the normalized request host into labels for
+// wildcard matching and, with MatchHostWithPort, a port.
+func (m *MatchToken) splitIncomingHost(reqHost string) (labels []string, port string) {
+	if !m.MatchHostWithPort {
+		return splitLabels(reqHost), ""
+	}
+	host, port := splitRequestHost(reqHost)
+	return splitLabels(strings.TrimSuffix(host, ".")), port
+}
+
+// matchHostPattern compares the labels and port of the incoming host against
+// the pattern. A "*" label matches exactly one label, and glob labels are
+// matched with path.Match; with anyDepth, one or more labels may precede the
+// pattern labels.
+func (m *MatchToken) matchHostPattern(pattern hostPattern, incomingParts []string, incomingPort string) bool {
+	if pattern.port != incomingPort {
+		return false
+	}
+	if pattern.anyDepth {
+		if len(incomingParts) <= len(pattern.labels) {
+			return false
+		}
+		incomingParts = incomingParts[len(incomingParts)-len(pattern.labels):]
+	} else if len(pattern.labels) != len(incomingParts) {
+		return false
+	}
+	for i := range pattern.labels {
+		if pattern.labels[i] == "*" {
+			continue
+		}
+		if pattern.globs[i] {
+			if ok, _ := path.Match(pattern.labels[i], incomingParts[i]); !ok {
+				return false
+			}
+			continue
+		}
+		if pattern.labels[i] != incomingParts[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// toASCIIHost converts an internationalized host sent as raw UTF-8 to its
+// IDNA ASCII form, as Provision does with the configured hosts. Hosts that
+// are already ASCII or can not be converted are returned unchanged.
+func toASCIIHost(host string) string {
+	if isASCII(host) {
+		return host
+	}
+	if ascii, err := hostToASCII(host); err == nil {
+		return ascii
+	}
+	return host
+}
+
+// hostToASCII converts host to its IDNA ASCII form. Wildcard patterns are
+// converted label by label, leaving the glob labels as they are, so that
+// "*.例え.jp" becomes "*.xn--r8jz45g.jp". A glob label that is not ASCII, such
+// as "例*", is an error: its punycode form would no longer match the labels
+// it was meant to.
+func hostToASCII(host string) (string, error) {
+	if !isGlob(host) {
+		return idna.ToASCII(host)
+	}
+	labels := strings.Split(host, ".")
+	for i, label := range labels {
+		if isASCII(label) {
+			continue
+		}
+		if isGlob(label) {
+			return "", fmt.Errorf("wildcard label '%s' is not ASCII; write it in punycode", label)
+		}
+		ascii, err := idna.ToASCII(label)
+		if err != nil {
+			return "", err
+		}
+		labels[i] = ascii
+	}
+	return strings.Join(labels, "."), nil
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// splitLabels splits host into its labels, or returns nil if any label is
+// empty, so that no wildcard matches a malformed host such as ".example.com".
+func splitLabels(host string) []string {
+	labels := strings.Split(host, ".")
+	for _, label := range labels {
+		if label == "" {
+			return nil
+		}
+	}
+	return labels
+}
+
+func (l *hostList) empty() bool {
+	return l.size() == 0 && !l.any
+}
+
+// size returns the number of host entries in the list.
+func (l *hostList) size() int {
+	n := len(l.exact) + len(l.exactSet) + len(l.wildcards) + len(l.leftmost) + len(l.placeholders) + len(l.regexps)
+	if l.exactTable != nil {
+		n += l.exactTable.len()
+	}
+	return n
+}
+
+// maxExpandedHostLen bounds the expansion of a host entry with placeholders:
+// the longest DNS name followed by a port.
+const maxExpandedHostLen = 253 + len(":65535")
+
+var errHostTooLong = errors.New("expanded host too long")
+
+// globEscaper escapes glob metacharacters in placeholder values.
+var globEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`)
+
+// expandHost expands the request placeholders of a host entry. Values are
+// inserted literally, with their glob metacharacters escaped, so a value sent
+// by the client such as "*" can not turn the entry into a wider pattern. The
+// replacer makes a single pass, so a value that looks like a placeholder is
+// not expanded in turn. It fails once the expansion is longer than any host,
+// without processing the rest of a large value further.
+func expandHost(tmpl string, repl *caddy.Replacer) (string, bool) {
+	n := len(tmpl)
+	host, err := repl.ReplaceFunc(tmpl, func(_ string, val any) (any, error) {
+		s := caddy.ToString(val)
+		if n += len(s); n > maxExpandedHostLen {
+			return nil, errHostTooLong
+		}
+		return globEscaper.Replace(s), nil
+	})
+	return host, err == nil
+}
+
+// normalizeHost brings a host from the request, or expanded from a
+// placeholder, to the form Provision gives to the host list: lowercased
+// unless CaseSensitiveHost, without a trailing dot and converted to ASCII.
+// Every lookup then compares normalized hosts byte by byte, so the exact
+// set, the binary search and the linear scan can not disagree.
+func (m *MatchToken) normalizeHost(host string) string {
+	if !m.CaseSensitiveHost {
+		// before the conversion, as upper and lower case letters are
+		// encoded differently
+		host = strings.ToLower(host)
+	}
+	return toASCIIHost(strings.TrimSuffix(host, "."))
 }
 
-func init() {
-	caddy.RegisterModule(matchToken{})
+// hostAndPort returns the request host as compared with the host entries,
+// with its port when MatchHostWithPort is set, and the port of the request.
+func (m *MatchToken) hostAndPort(req *http.Request) (string, string) {
+	rawHost := m.requestHost(req)
+	reqHost, reqPort := splitRequestHost(rawHost)
+	if m.MatchHostWithPort {
+		reqHost = rawHost
+	}
+	return reqHost, reqPort
 }
 
-func (m *matchToken) Provision(ctx caddy.Context) error {
-	// check for duplicates; they are nonsensical and reduce efficiency
-	// (we could just remove them, but the user should know their config is erroneous)
-	seen := make(map[string]int, len(m.Host))
-	for i, host := range m.Host {
-		asciiHost, err := idna.ToASCII(host)
-		if err != nil {
-			return fmt.Errorf("converting hostname '%s' to ASCII: %v", host, err)
+// requestHost returns the host the client asked for: the Host header, the
+// first X-Forwarded-Host value with TrustForwardedHost, or the TLS server name
+// with UseTLSSNI, along with the port of the Host header.
+func (m *MatchToken) requestHost(req *http.Request) string {
+	if m.UseTLSSNI && req.TLS != nil && req.TLS.ServerName != "" {
+		if _, port := splitRequestHost(req.Host); port != "" {
+			return net.JoinHostPort(req.TLS.ServerName, port)
 		}
-		if asciiHost != host {
-			m.Host[i] = asciiHost
+		return req.TLS.ServerName
+	}
+	if m.TrustForwardedHost {
+		if fwd := req.Header.Get("X-Forwarded-Host"); fwd != "" {
+			first, _, _ := strings.Cut(fwd, ",")
+			return strings.TrimSpace(first)
 		}
-		normalizedHost := strings.ToLower(asciiHost)
-		if firstI, ok := seen[normalizedHost]; ok {
-			return fmt.Errorf("host at index %d is repeated at index %d: %s", firstI, i, host)
+	}
+	return req.Host
+}
+
+// requireHostMatch reports whether RequireHostMatch is set, which it is by
+// default.
+func (m *MatchToken) requireHostMatch() bool {
+	return m.RequireHostMatch == nil || *m.RequireHostMatch
+}
+
+// splitRequestHost splits a Host header value into host and port, never
+// failing:
+//   - "example.com:8080" gives "example.com" and "8080", and "example.com:"
+//     an empty port;
+//   - IPv6 addresses lose their brackets: "[::1]:443" gives "::1" and "443",
+//     and "[::1]" gives "::1";
+//   - ":8080" gives an empty host, which only the "*" entry matches;
+//   - values net.SplitHostPort rejects, such as "::1" or "a:b:c", are the
+//     host as a whole, without surrounding brackets, and have no port;
+//   - an empty value gives an empty host and port.
+//
+// A trailing dot, as in "example.com.:443", is kept here and removed by
+// normalizeHost, as is the case of letters.
+func splitRequestHost(raw string) (host, port string) {
+	host, port, err := net.SplitHostPort(raw)
+	if err != nil {
+		// OK; probably didn't have a port
+		return strings.TrimSuffix(strings.TrimPrefix(raw, "["), "]"), ""
+	}
+	return host, port
+}
+
+// hasMethod reports whether method is one of Methods, which Provision
+// stores uppercased.
+func (m *MatchToken) hasMethod(method string) bool {
+	method = strings.ToUpper(method)
+	for _, mth := range m.Methods {
+		if mth == method {
+			return true
 		}
-		seen[normalizedHost] = i
 	}
+	return false
+}
 
-	if m.large() {
-		// sort the slice lexicographically, grouping "fuzzy" entries (wildcards and placeholders)
-		// at the front of the list; this allows us to use binary search for exact matches, which
-		// we have seen from experience is the most common kind of value in large lists; and any
-		// other kinds of values (wildcards and placeholders) are grouped in front so the linear
-		// search should find a match fairly quickly
-		sort.Slice(m.Host, func(i, j int) bool {
-			iInexact, jInexact := m.fuzzy(m.Host[i]), m.fuzzy(m.Host[j])
-			if iInexact && !jInexact {
-				return true
-			}
-			if !iInexact && jInexact {
-				return false
+// headersMatch reports whether every header of HeaderMatches has its value.
+func (m *MatchToken) headersMatch(req *http.Request) bool {
+	for name, want := range m.HeaderMatches {
+		found := false
+		for _, value := range req.Header.Values(name) {
+			if value == want || m.CaseInsensitiveHeaderMatches && strings.EqualFold(value, want) {
+				found = true
+				break
 			}
-			return m.Host[i] < m.Host[j]
-		})
+		}
+		if !found {
+			return false
+		}
 	}
-	return nil
+	return true
 }
 
-// CaddyModule returns the Caddy module information.
-func (matchToken) CaddyModule() caddy.ModuleInfo {
-	return caddy.ModuleInfo{
-		ID:  "http.matchers.matchToken",
-		New: func() caddy.Module { return new(matchToken) },
+// queryMatches reports whether every parameter of QueryMatches has its value.
+func (m *MatchToken) queryMatches(req *http.Request) bool {
+	query := req.URL.Query()
+	for key, want := range m.QueryMatches {
+		if !slices.Contains(query[key], want) {
+			return false
+		}
+	}
+	return true
+}
+
+// hasPort reports whether the request port, inferred from the connection when
+// the Host header has none, is one of Ports.
+func (m *MatchToken) hasPort(req *http.Request, port string) bool {
+	if port == "" {
+		port = "80"
+		if req.TLS != nil {
+			port = "443"
+		}
+	}
+	for _, p := range m.Ports {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
+
+// hasPathPrefix reports whether path is under one of PathPrefixes, which
+// Provision stores without a trailing slash.
+func (m *MatchToken) hasPathPrefix(path string) bool {
+	for _, prefix := range m.PathPrefixes {
+		if path == prefix || strings.HasPrefix(path, prefix+"/") {
+			return true
+		}
 	}
+	return false
 }
 
 /**
- * Verifico que el token que me mandan tenga el prefijo especificado, si fuera el caso, entonces valido el host. Las 2 condiciones se deben de cumplir para regresar verdadero
+ * Obtiene el token de la peticion probando las fuentes en el orden configurado; por defecto primero de los headers,
+ * luego del Authorization, de la cookie, del query string, del path, del formulario, del Sec-WebSocket-Protocol
+ * y al final del password de Basic Auth
+ * @param req La peticion que me mandan a evaluar
  */
-func (m *matchToken) Match(req *http.Request) bool {
-	token := req.Header.Get("token")
-	if len(token) == 0 {
-		cookie, err := req.Cookie("token")
-		if err != nil {
-			return false
+func (m *MatchToken) extractToken(req *http.Request) (token, source string, ok bool) {
+	for _, source := range m.sources {
+		if token, ok := m.sourceToken(req, source); ok {
+			return token, source, true
 		}
-		token = cookie.Value
 	}
-	if !m.hasPrefix(token) {
-		return false
+	return "", "", false
+}
+
+// sourceToken reads the token from a single source. Cookies yield their value
+// even when empty; the other sources yield only non-empty values.
+func (m *MatchToken) sourceToken(req *http.Request, source string) (string, bool) {
+	var token string
+	switch source {
+	case tokenSourceHeader:
+		for _, name := range m.headerNames {
+			if token = req.Header.Get(name); len(token) > 0 {
+				break
+			}
+		}
+	case tokenSourceAuthorization:
+		token = req.Header.Get("Authorization")
+		if m.ReadBasicAuthPassword && hasBasicScheme(token) {
+			token = ""
+		}
+	case tokenSourceCookie:
+		for _, name := range m.cookieNames {
+			if cookie, err := req.Cookie(name); err == nil {
+				return cookie.Value, true
+			}
+		}
+	case tokenSourceQuery:
+		token = req.URL.Query().Get(m.QueryParam)
+	case tokenSourcePath:
+		token = pathSegment(req.URL.Path, *m.PathTokenIndex)
+	case tokenSourceForm:
+		token = m.formToken(req)
+	case tokenSourceWebSocket:
+		token = m.webSocketProtocolToken(req)
+	case tokenSourceBasicAuth:
+		token, present, _ := m.basicAuthToken(req)
+		return token, present
 	}
-	/********************************************************************************************************/
-	reqHost, _, err := net.SplitHostPort(req.Host)
-	if err != nil {
-		// OK; probably didn't have a port
-		reqHost = req.Host
+	return token, len(token) > 0
+}
 
-		// make sure we strip the brackets from IPv6 addresses
-		reqHost = strings.TrimPrefix(reqHost, "[")
-		reqHost = strings.TrimSuffix(reqHost, "]")
+// basicAuthToken returns the password of the Basic credentials of req, and
+// reports whether there are Basic credentials and whether they are well
+// formed and carry BasicAuthUsername, if set.
+func (m *MatchToken) basicAuthToken(req *http.Request) (token string, present, valid bool) {
+	if !hasBasicScheme(req.Header.Get("Authorization")) {
+		return "", false, false
+	}
+	user, password, ok := req.BasicAuth()
+	if !ok {
+		return "", true, false
 	}
+	if m.BasicAuthUsername != "" && subtle.ConstantTimeCompare([]byte(user), []byte(m.BasicAuthUsername)) != 1 {
+		return "", true, false
+	}
+	return password, true, true
+}
 
-	if m.large() {
-		// fast path: locate exact match using binary search (about 100-1000x faster for large lists)
-		pos := sort.Search(len(m.Host), func(i int) bool {
-			if m.fuzzy(m.Host[i]) {
-				return false
+// hasBasicScheme reports whether an Authorization header value uses the
+// Basic scheme.
+func hasBasicScheme(value string) bool {
+	const scheme = "basic "
+	return len(value) >= len(scheme) && strings.EqualFold(value[:len(scheme)], scheme)
+}
+
+// conflictingTokens reports whether the sources yield different non-empty
+// tokens, once normalized as StrictSingleSource describes.
+func (m *MatchToken) conflictingTokens(req *http.Request) bool {
+	first := ""
+	for _, source := range m.sources {
+		for _, token := range m.sourceTokens(req, source) {
+			if m.TrimSpace {
+				token = strings.TrimSpace(token)
+			}
+			if m.StripBearer {
+				token = stripBearer(token)
+			}
+			if token == "" {
+				continue
+			}
+			if first == "" {
+				first = token
+			} else if token != first {
+				return true
 			}
-			return m.Host[i] >= reqHost
-		})
-		if pos < len(m.Host) && m.Host[pos] == reqHost {
-			return true
 		}
 	}
+	return false
+}
 
-	repl := req.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+// sourceTokens is like sourceToken, but yields the value of every configured
+// header or cookie name rather than the first one.
+func (m *MatchToken) sourceTokens(req *http.Request, source string) []string {
+	var tokens []string
+	switch source {
+	case tokenSourceHeader:
+		for _, name := range m.headerNames {
+			tokens = append(tokens, req.Header.Get(name))
+		}
+	case tokenSourceCookie:
+		for _, name := range m.cookieNames {
+			if cookie, err := req.Cookie(name); err == nil {
+				tokens = append(tokens, cookie.Value)
+			}
+		}
+	default:
+		token, _ := m.sourceToken(req, source)
+		tokens = append(tokens, token)
+	}
+	return tokens
+}
 
-outer:
-	for _, host := range m.Host {
-		// fast path: if matcher is large, we already know we don't have an exact
-		// match, so we're only looking for fuzzy match now, which should be at the
-		// front of the list; if we have reached a value that is not fuzzy, there
-		// will be no match and we can short-circuit for efficiency
-		if m.large() && !m.fuzzy(host) {
-			break
+// provisionSources validates Sources, or lists the enabled sources in the
+// default order if it is empty.
+func (m *MatchToken) provisionSources() error {
+	if len(m.Sources) == 0 {
+		for _, source := range defaultTokenSources {
+			if m.sourceEnabled(source) {
+				m.sources = append(m.sources, source)
+			}
+		}
+		return nil
+	}
+	seen := make(map[string]bool, len(m.Sources))
+	for _, source := range m.Sources {
+		option, known := sourceOptions[source]
+		if !known {
+			return fmt.Errorf("unrecognized token source '%s'", source)
+		}
+		if !m.sourceEnabled(source) {
+			return fmt.Errorf("token source '%s' is not enabled; set %s", source, option)
+		}
+		if seen[source] {
+			return fmt.Errorf("token source '%s' is listed twice", source)
 		}
+		seen[source] = true
+	}
+	m.sources = m.Sources
+	return nil
+}
+
+// sourceEnabled reports whether the option a source needs is set. Headers and
+// cookies have default names and are always enabled.
+func (m *MatchToken) sourceEnabled(source string) bool {
+	switch source {
+	case tokenSourceAuthorization:
+		return m.StripBearer
+	case tokenSourceQuery:
+		return m.QueryParam != ""
+	case tokenSourcePath:
+		return m.PathTokenIndex != nil
+	case tokenSourceForm:
+		return m.FormField != ""
+	case tokenSourceWebSocket:
+		return m.ReadWebSocketProtocol
+	case tokenSourceBasicAuth:
+		return m.ReadBasicAuthPassword
+	}
+	return true
+}
 
-		host = repl.ReplaceAll(host, "")
-		if strings.Contains(host, "*") {
-			patternParts := strings.Split(host, ".")
-			incomingParts := strings.Split(reqHost, ".")
-			if len(patternParts) != len(incomingParts) {
+// webSocketProtocolToken returns the token carried in the subprotocols
+// requested by a WebSocket client, or "" if there is none.
+func (m *MatchToken) webSocketProtocolToken(req *http.Request) string {
+	for _, value := range req.Header.Values("Sec-WebSocket-Protocol") {
+		for _, protocol := range strings.Split(value, ",") {
+			protocol = strings.TrimSpace(protocol)
+			if protocol == "" {
 				continue
 			}
-			for i := range patternParts {
-				if patternParts[i] == "*" {
-					continue
-				}
-				if !strings.EqualFold(patternParts[i], incomingParts[i]) {
-					continue outer
-				}
+			if m.WebSocketProtocolPrefix == "" {
+				return protocol
 			}
-			return true
-		} else if strings.EqualFold(reqHost, host) {
+			// a bare prefix carries no token, but a later subprotocol may
+			if token, ok := strings.CutPrefix(protocol, m.WebSocketProtocolPrefix); ok && token != "" {
+				return token
+			}
+		}
+	}
+	return ""
+}
+
+// Names of the places a token can be read from.
+const (
+	tokenSourceHeader        = "header"
+	tokenSourceAuthorization = "authorization"
+	tokenSourceCookie        = "cookie"
+	tokenSourceQuery         = "query"
+	tokenSourcePath          = "path"
+	tokenSourceForm          = "form"
+	tokenSourceWebSocket     = "websocket_protocol"
+	tokenSourceBasicAuth     = "basic_auth"
+)
+
+// defaultTokenSources is the order sources are tried in when Sources is empty.
+var defaultTokenSources = []string{
+	tokenSourceHeader,
+	tokenSourceAuthorization,
+	tokenSourceCookie,
+	tokenSourceQuery,
+	tokenSourcePath,
+	tokenSourceForm,
+	tokenSourceWebSocket,
+	tokenSourceBasicAuth,
+}
+
+// sourceOptions maps each token source to the option enabling it, if any.
+var sourceOptions = map[string]string{
+	tokenSourceHeader:        "",
+	tokenSourceAuthorization: "strip_bearer",
+	tokenSourceCookie:        "",
+	tokenSourceQuery:         "query_param",
+	tokenSourcePath:          "path_token_index",
+	tokenSourceForm:          "form_field",
+	tokenSourceWebSocket:     "read_websocket_protocol",
+	tokenSourceBasicAuth:     "read_basic_auth_password",
+}
+
+// pathSegment returns the segment of path at index, 0 being the first one
+// after the leading slash, or "" if there is no such segment.
+func pathSegment(path string, index int) string {
+	segments := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	if index < 0 || index >= len(segments) {
+		return ""
+	}
+	return segments[index]
+}
+
+// checkToken prepares an extracted token and evaluates it, returning the
+// prepared token. valid is false for tokens that must be rejected outright,
+// even when negated.
+func (m *MatchToken) checkToken(token string, repl *caddy.Replacer) (prepared string, allowed, valid bool) {
+	if m.TrimSpace {
+		token = strings.TrimSpace(token)
+	}
+	if m.StripBearer {
+		token = stripBearer(token)
+	}
+	if !m.validLength(token) {
+		return "", false, false
+	}
+	if m.DecodeBase64 {
+		decoded, err := decodeBase64(token)
+		if err != nil {
+			return "", false, false
+		}
+		token = decoded
+	}
+	return token, m.tokenAllowed(token, repl), true
+}
+
+// validLength reports whether the token length is within MinLength and MaxLength.
+func (m *MatchToken) validLength(token string) bool {
+	if m.MinLength > 0 && len(token) < m.MinLength {
+		return false
+	}
+	if m.MaxLength > 0 && len(token) > m.MaxLength {
+		return false
+	}
+	return true
+}
+
+// tokenAllowed reports whether the token satisfies every configured token
+// criterion. Cheaper checks run first.
+func (m *MatchToken) tokenAllowed(token string, repl *caddy.Replacer) bool {
+	if !m.hasTokenCriteria() {
+		return false
+	}
+	if m.RequireTokenPresent && token == "" {
+		return false
+	}
+	if m.Suffix != "" && !strings.HasSuffix(token, m.Suffix) {
+		return false
+	}
+	if m.checksumValid != nil && !m.checksumValid(token) {
+		return false
+	}
+	if m.Expiry != nil && !m.Expiry.valid(token, time.Now()) {
+		return false
+	}
+	if !m.prefixOrListed(token, repl) {
+		return false
+	}
+	if len(m.ExcludePrefixes) > 0 && m.hasExcludedPrefix(token) {
+		return false
+	}
+	if m.tokenRegexp != nil && !m.tokenRegexp.MatchString(token) {
+		return false
+	}
+	if m.hmacHash != nil && !m.validHMAC(token) {
+		return false
+	}
+	if m.JWT != nil && !m.JWT.verify(token) {
+		return false
+	}
+	if m.UnverifiedClaimMatch && !unverifiedAudience(token, m.UnverifiedAudience) {
+		return false
+	}
+	if m.bloom != nil && !m.bloom.mayContain(token) {
+		return false
+	}
+	if m.Allowlist != nil && !m.Allowlist.allowed(token) {
+		return false
+	}
+	return true
+}
+
+// hasTokenCriteria reports whether any token criterion is configured.
+func (m *MatchToken) hasTokenCriteria() bool {
+	return m.RequireTokenPresent ||
+		m.hasPrefixes() ||
+		len(m.Tokens) > 0 ||
+		m.Suffix != "" ||
+		m.TokenRegex != "" ||
+		m.HMACSecret != "" ||
+		m.JWT != nil ||
+		m.UnverifiedClaimMatch ||
+		m.Expiry != nil ||
+		m.Allowlist != nil ||
+		m.BloomFilterFile != ""
+}
+
+// prefixOrListed reports whether the token satisfies the configured exact
+// tokens and prefixes, combined according to TokensMode. It passes when
+// neither is configured.
+func (m *MatchToken) prefixOrListed(token string, repl *caddy.Replacer) bool {
+	if len(m.Tokens) == 0 && !m.hasPrefixes() {
+		return true
+	}
+	if len(m.Tokens) == 0 {
+		return m.hasPrefix(token, repl)
+	}
+	if !m.hasPrefixes() {
+		return m.isListedToken(token)
+	}
+	if m.TokensMode == "all" {
+		return m.isListedToken(token) && m.hasPrefix(token, repl)
+	}
+	return m.isListedToken(token) || m.hasPrefix(token, repl)
+}
+
+// hasExcludedPrefix reports whether the token has one of ExcludePrefixes.
+func (m *MatchToken) hasExcludedPrefix(token string) bool {
+	if m.CaseInsensitivePrefix {
+		token = strings.ToLower(token)
+	}
+	for _, prefix := range m.ExcludePrefixes {
+		if strings.HasPrefix(token, prefix) {
 			return true
 		}
 	}
 	return false
 }
 
+// hasPrefixes reports whether any prefix, static or request-dependent, is configured.
+func (m *MatchToken) hasPrefixes() bool {
+	return len(m.Prefix) > 0 || len(m.prefixTemplates) > 0 || m.PrefixTemplate != "" || m.PrefixFile != ""
+}
+
+// provisionPrefixes resolves global placeholders in Prefix and moves the
+// prefixes that still depend on the request to prefixTemplates.
+func (m *MatchToken) provisionPrefixes() error {
+	globalRepl := caddy.NewReplacer()
+	prefixes := make([]string, 0, len(m.Prefix))
+	for _, prefix := range m.Prefix {
+		if strings.Contains(prefix, "{") {
+			resolved := globalRepl.ReplaceKnown(prefix, "")
+			if resolved == "" {
+				return fmt.Errorf("token prefix '%s' expands to an empty string", prefix)
+			}
+			if strings.Contains(resolved, "{") {
+				m.prefixTemplates = append(m.prefixTemplates, resolved)
+				continue
+			}
+			prefix = resolved
+		}
+		if m.CaseInsensitivePrefix {
+			prefix = strings.ToLower(prefix)
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	m.Prefix = prefixes
+	for i, prefix := range m.ExcludePrefixes {
+		if prefix == "" {
+			return fmt.Errorf("empty exclude prefix would reject every token")
+		}
+		if m.CaseInsensitivePrefix {
+			m.ExcludePrefixes[i] = strings.ToLower(prefix)
+		}
+	}
+	return nil
+}
+
+// provisionEnvPrefixes adds the values of the environment variables matching
+// PrefixEnv to Prefix, ordered by variable name. They are taken literally.
+func (m *MatchToken) provisionEnvPrefixes() error {
+	if m.PrefixEnv == "" {
+		return nil
+	}
+	if _, err := path.Match(m.PrefixEnv, ""); err != nil {
+		return fmt.Errorf("invalid prefix_env pattern '%s': %v", m.PrefixEnv, err)
+	}
+	var names []string
+	for _, kv := range os.Environ() {
+		name, _, _ := strings.Cut(kv, "=")
+		if ok, _ := path.Match(m.PrefixEnv, name); ok {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return fmt.Errorf("no environment variable matches prefix_env '%s'", m.PrefixEnv)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		prefix := os.Getenv(name)
+		if prefix == "" {
+			return fmt.Errorf("environment variable %s of prefix_env is empty", name)
+		}
+		if m.CaseInsensitivePrefix {
+			prefix = strings.ToLower(prefix)
+		}
+		m.Prefix = append(m.Prefix, prefix)
+	}
+	return nil
+}
+
+// loadPrefixes returns the static prefixes merged with those in PrefixFile.
+func (m *MatchToken) loadPrefixes() ([]string, error) {
+	if m.PrefixFile == "" {
+		return m.Prefix, nil
+	}
+	filePrefixes, err := readListFile(m.PrefixFile)
+	if err != nil {
+		return nil, categorized(CategoryFile, fmt.Errorf("reading prefix file %s: %v", m.PrefixFile, err))
+	}
+	prefixes := append(make([]string, 0, len(m.Prefix)+len(filePrefixes)), m.Prefix...)
+	for _, prefix := range filePrefixes {
+		if m.CaseInsensitivePrefix {
+			prefix = strings.ToLower(prefix)
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
+
+// staticPrefixes returns the prefixes not depending on the request, which
+// may be swapped by a reload of PrefixFile.
+func (m *MatchToken) staticPrefixes() []string {
+	if m.reloadMu == nil {
+		return m.prefixes
+	}
+	m.reloadMu.RLock()
+	defer m.reloadMu.RUnlock()
+	return m.prefixes
+}
+
+// expandPrefixes returns the static prefixes along with prefixTemplates
+// expanded for the request, skipping those expandPrefix rejects.
+func (m *MatchToken) expandPrefixes(repl *caddy.Replacer) []string {
+	static := m.staticPrefixes()
+	prefixes := append(make([]string, 0, len(static)+len(m.prefixTemplates)), static...)
+	for _, tmpl := range m.prefixTemplates {
+		if prefix, ok := m.expandPrefix(tmpl, repl); ok {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	return prefixes
+}
+
+// expandPrefix expands the request placeholders of a prefix template. It
+// fails if any of them is unknown or empty: a missing value would otherwise
+// turn "{http.request.header.X-Tenant}-" into "-", accepting far more tokens
+// than intended.
+func (m *MatchToken) expandPrefix(tmpl string, repl *caddy.Replacer) (string, bool) {
+	prefix, err := repl.ReplaceOrErr(tmpl, true, true)
+	if err != nil || prefix == "" {
+		return "", false
+	}
+	if m.CaseInsensitivePrefix {
+		prefix = strings.ToLower(prefix)
+	}
+	return prefix, true
+}
+
+// tokenHashPrefix marks a Tokens entry holding the hex SHA-256 digest of a token.
+const tokenHashPrefix = "sha256:"
+
+// provisionTokens splits Tokens into plain tokens and decoded digests.
+func (m *MatchToken) provisionTokens() error {
+	for _, t := range m.Tokens {
+		if !strings.HasPrefix(t, tokenHashPrefix) {
+			m.plainTokens = append(m.plainTokens, t)
+			continue
+		}
+		sum, err := hex.DecodeString(strings.TrimPrefix(t, tokenHashPrefix))
+		if err != nil || len(sum) != sha256.Size {
+			return fmt.Errorf("token hash '%s' must be %s followed by %d hex digits", t, tokenHashPrefix, 2*sha256.Size)
+		}
+		m.tokenHashes = append(m.tokenHashes, sum)
+	}
+	// sorted so exact tokens can be found with binary search
+	sort.Strings(m.plainTokens)
+	return nil
+}
+
+// isListedToken reports whether the token is exactly one of Tokens.
+func (m *MatchToken) isListedToken(token string) bool {
+	if len(m.tokenHashes) > 0 {
+		sum := sha256.Sum256([]byte(token))
+		matched := 0
+		for _, h := range m.tokenHashes {
+			matched |= subtle.ConstantTimeCompare(sum[:], h)
+		}
+		if matched == 1 {
+			return true
+		}
+	}
+	if m.ConstantTime {
+		matched := 0
+		for _, t := range m.plainTokens {
+			matched |= subtle.ConstantTimeCompare([]byte(token), []byte(t))
+		}
+		return matched == 1
+	}
+	pos := sort.SearchStrings(m.plainTokens, token)
+	return pos < len(m.plainTokens) && m.plainTokens[pos] == token
+}
+
 /**
- * Verifica que el token tenga la lista de prefijos que me indican
+ * Verifica que el token tenga la lista de prefijos que me indican; un token vacio nunca tiene prefijo,
+ * ni siquiera el prefijo vacio
  * @param token El token que me mandan a evaluar
  */
-func (m *matchToken) hasPrefix(token string) bool {
-	for v := range m.Prefix {
-		if strings.HasPrefix(token, m.Prefix[v]) {
-			return true
+func (m *MatchToken) hasPrefix(token string, repl *caddy.Replacer) bool {
+	_, ok := m.matchedPrefix(token, repl)
+	return ok
+}
+
+// matchedPrefix is like hasPrefix but also returns the prefix, after
+// placeholder expansion, that the token satisfied.
+func (m *MatchToken) matchedPrefix(token string, repl *caddy.Replacer) (string, bool) {
+	if token == "" {
+		return "", false
+	}
+	if m.CaseInsensitivePrefix {
+		token = strings.ToLower(token)
+	}
+	prefixes := m.staticPrefixes()
+	if m.PrefixTemplate != "" {
+		prefix, ok := m.expandPrefix(m.PrefixTemplate, repl)
+		if !ok {
+			return "", false
 		}
+		prefixes = []string{prefix}
+	} else if len(m.prefixTemplates) > 0 {
+		prefixes = m.expandPrefixes(repl)
 	}
-	return false
+	if m.ConstantTime {
+		if i := hasPrefixConstantTime(token, prefixes, m.MatchMode, m.RequireSeparatorAfterPrefix); i >= 0 {
+			return prefixes[i], true
+		}
+		return "", false
+	}
+	for v := range prefixes {
+		if matchesMode(token, prefixes[v], m.MatchMode, m.RequireSeparatorAfterPrefix) {
+			return prefixes[v], true
+		}
+	}
+	return "", false
+}
+
+// matchesMode reports whether token contains needle at the place required by
+// mode, as described in MatchMode. In "prefix" mode a non-empty sep must
+// follow the needle unless the token equals it.
+func matchesMode(token, needle, mode, sep string) bool {
+	switch mode {
+	case "suffix":
+		return strings.HasSuffix(token, needle)
+	case "contains":
+		return strings.Contains(token, needle)
+	case "exact":
+		return token == needle
+	default:
+		if sep != "" && len(token) != len(needle) {
+			needle += sep
+		}
+		return strings.HasPrefix(token, needle)
+	}
+}
+
+// tokenFingerprint identifies a token in logs without revealing it: the first
+// 8 hex digits of its SHA-256 hash.
+func tokenFingerprint(token string) string {
+	if token == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:4])
+}
+
+// decodeBase64 decodes s using the URL-safe alphabet if it contains any of its
+// specific characters, or the standard one otherwise. Padding is optional.
+func decodeBase64(s string) (string, error) {
+	enc := base64.RawStdEncoding
+	if strings.ContainsAny(s, "-_") {
+		enc = base64.RawURLEncoding
+	}
+	b, err := enc.DecodeString(strings.TrimRight(s, "="))
+	return string(b), err
+}
+
+// stripBearer removes a case-insensitive "Bearer" scheme followed by at least
+// one space or tab, so values that merely start with "Bearer" are left intact.
+func stripBearer(token string) string {
+	token = strings.TrimSpace(token)
+	const scheme = "bearer"
+	if len(token) <= len(scheme) || !strings.EqualFold(token[:len(scheme)], scheme) {
+		return token
+	}
+	if token[len(scheme)] != ' ' && token[len(scheme)] != '\t' {
+		return token
+	}
+	return strings.TrimLeft(token[len(scheme):], " \t")
+}
+
+// hasPrefixConstantTime is like matchedPrefix, but does not short-circuit on
+// the first mismatched byte nor on the first matching prefix. Only the token
+// length relative to each prefix length is observable. It returns the index
+// of the last matching prefix, or -1.
+func hasPrefixConstantTime(token string, prefixes []string, mode, sep string) int {
+	matched := -1
+	for v, prefix := range prefixes {
+		if sep != "" && len(token) != len(prefix) {
+			// Provision allows sep only in "prefix" mode
+			prefix += sep
+		}
+		if len(token) < len(prefix) {
+			continue
+		}
+		eq := 0
+		switch mode {
+		case "suffix":
+			eq = subtle.ConstantTimeCompare([]byte(token[len(token)-len(prefix):]), []byte(prefix))
+		case "contains":
+			for i := 0; i+len(prefix) <= len(token); i++ {
+				eq |= subtle.ConstantTimeCompare([]byte(token[i:i+len(prefix)]), []byte(prefix))
+			}
+		case "exact":
+			eq = subtle.ConstantTimeCompare([]byte(token), []byte(prefix))
+		default:
+			eq = subtle.ConstantTimeCompare([]byte(token[:len(prefix)]), []byte(prefix))
+		}
+		matched = subtle.ConstantTimeSelect(eq, v, matched)
+	}
+	return matched
 }
 
-func (matchToken) fuzzy(h string) bool { return strings.ContainsAny(h, "{*") }
-func (m matchToken) large() bool       { return len(m.Host) > 100 }
+func (m *MatchToken) large(hosts []string) bool {
+	threshold := m.LargeThreshold
+	if threshold == 0 {
+		threshold = 100
+	}
+	return len(hosts) > threshold
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner        = (*MatchToken)(nil)
+	_ caddy.Validator          = (*MatchToken)(nil)
+	_ caddy.CleanerUpper       = (*MatchToken)(nil)
+	_ caddyhttp.RequestMatcher = (*MatchToken)(nil)
+	_ caddyfile.Unmarshaler    = (*MatchToken)(nil)
+)
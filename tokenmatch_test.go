@@ -0,0 +1,1000 @@
+package caddy_matchtoken
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// provisionMatcher provisions and validates m with a silent logger, and
+// cleans it up at the end of the test.
+func provisionMatcher(tb testing.TB, m *MatchToken) *MatchToken {
+	tb.Helper()
+	if err := m.provision(zap.NewNop()); err != nil {
+		tb.Fatalf("provisioning: %v", err)
+	}
+	if err := m.Validate(); err != nil {
+		tb.Fatalf("validating: %v", err)
+	}
+	tb.Cleanup(func() { m.Cleanup() })
+	return m
+}
+
+// newRequest returns a request for target with the given headers and a
+// replacer in its context, as Caddy's HTTP server would.
+func newRequest(target string, header map[string]string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	for name, value := range header {
+		req.Header.Set(name, value)
+	}
+	ctx := context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer())
+	return req.WithContext(ctx)
+}
+
+func TestDecisionCacheTemplatedRulePrefix(t *testing.T) {
+	for _, m := range []*MatchToken{
+		{Rules: []TokenRule{{Prefix: "{http.request.header.X-Tenant}_", Host: []string{"a.example.com"}}}, DecisionCacheSize: 10},
+		{HostPrefixes: []HostPrefix{{Host: "a.example.com", Prefix: "{http.request.header.X-Tenant}_"}}, DecisionCacheSize: 10},
+	} {
+		if err := m.provision(zap.NewNop()); err == nil {
+			t.Errorf("expected an error for a templated rule prefix with a decision cache")
+		}
+	}
+}
+
+func TestDecisionCacheRuleTTL(t *testing.T) {
+	m := provisionMatcher(t, &MatchToken{
+		Rules:             []TokenRule{{Prefix: "r_", Host: []string{"r.example.com"}}},
+		HostPrefixes:      []HostPrefix{{Host: "h.example.com", Prefix: "h_"}},
+		DecisionCacheSize: 10,
+	})
+	for _, r := range append(m.rules, m.hostRules...) {
+		if r.DecisionCacheTTL != m.DecisionCacheTTL {
+			t.Errorf("rule TTL is %v, want %v", r.DecisionCacheTTL, m.DecisionCacheTTL)
+		}
+	}
+	req := newRequest("http://r.example.com/", map[string]string{"token": "r_abc"})
+	for i := 0; i < 2; i++ {
+		if !m.Match(req) {
+			t.Fatalf("request %d did not match", i)
+		}
+	}
+	if n := m.rules[0].decisions.order.Len(); n != 1 {
+		t.Errorf("rule cache has %d entries, want 1", n)
+	}
+}
+
+// BenchmarkDecisionCache compares repeated tokens on a large wildcard host
+// list with and without the decision cache.
+func BenchmarkDecisionCache(b *testing.B) {
+	hosts := make([]string, 2000)
+	for i := range hosts {
+		hosts[i] = fmt.Sprintf("api-%d.*.example.com", i)
+	}
+	for _, size := range []int{0, 1000} {
+		b.Run(fmt.Sprintf("cache=%d", size), func(b *testing.B) {
+			m := provisionMatcher(b, &MatchToken{Prefix: []string{"abc"}, Host: hosts, DecisionCacheSize: size})
+			reqs := make([]*http.Request, 16)
+			for i := range reqs {
+				reqs[i] = newRequest("http://api-1999.eu.example.com/", map[string]string{"token": fmt.Sprintf("abc%d", i)})
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if !m.Match(reqs[i%len(reqs)]) {
+					b.Fatal("no match")
+				}
+			}
+		})
+	}
+}
+
+func TestEmptyPrefix(t *testing.T) {
+	m := &MatchToken{Prefix: []string{""}, Host: []string{"example.com"}}
+	if err := m.provision(zap.NewNop()); err != nil {
+		t.Fatalf("provisioning: %v", err)
+	}
+	if err := m.Validate(); err == nil {
+		t.Errorf("expected an empty prefix to fail validation without allow_empty_prefix")
+	}
+
+	m = provisionMatcher(t, &MatchToken{Prefix: []string{""}, AllowEmptyPrefix: true, Host: []string{"example.com"}})
+	for _, tt := range []struct {
+		name   string
+		header map[string]string
+		want   bool
+	}{
+		{"token present", map[string]string{"token": "anything"}, true},
+		{"token absent", nil, false},
+		{"empty header", map[string]string{"token": ""}, false},
+		{"cookie only", map[string]string{"Cookie": "token=anything"}, true},
+		{"empty cookie", map[string]string{"Cookie": "token="}, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := m.Match(newRequest("http://example.com/", tt.header)); got != tt.want {
+				t.Errorf("Match() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitRequestHost(t *testing.T) {
+	for _, tt := range []struct {
+		raw, host, port string
+	}{
+		{"", "", ""},
+		{"example.com", "example.com", ""},
+		{"example.com:8080", "example.com", "8080"},
+		{"host:", "host", ""},
+		{":8080", "", "8080"},
+		{"[::1]:443", "::1", "443"},
+		{"[::1]", "::1", ""},
+		{"::1", "::1", ""},
+		{"a:b:c", "a:b:c", ""},
+		{"example.com.", "example.com.", ""},
+		{"example.com.:443", "example.com.", "443"},
+	} {
+		host, port := splitRequestHost(tt.raw)
+		if host != tt.host || port != tt.port {
+			t.Errorf("splitRequestHost(%q) = %q, %q; want %q, %q", tt.raw, host, port, tt.host, tt.port)
+		}
+	}
+}
+
+func TestMalformedRequestHost(t *testing.T) {
+	m := provisionMatcher(t, &MatchToken{Prefix: []string{"abc"}, Host: []string{"example.com", "::1"}})
+	for _, tt := range []struct {
+		host string
+		want bool
+	}{
+		{"example.com.", true},
+		{"EXAMPLE.com.:443", true},
+		{"[::1]:443", true},
+		{"[::1]", true},
+		{"example.com:", true},
+		{":8080", false},
+		{"", false},
+	} {
+		req := newRequest("http://example.com/", map[string]string{"token": "abc1"})
+		req.Host = tt.host
+		if got := m.Match(req); got != tt.want {
+			t.Errorf("Host %q: Match() = %v, want %v", tt.host, got, tt.want)
+		}
+	}
+}
+
+// hostLookups are configurations exercising each way of looking up exact
+// hosts: the linear scan, binary search, the map and the compact table.
+var hostLookups = []struct {
+	name  string
+	setup func(m *MatchToken)
+}{
+	{"linear", func(m *MatchToken) {}},
+	{"binary", func(m *MatchToken) { m.LargeThreshold = 1 }},
+	{"map", func(m *MatchToken) { m.ExactHostLookup = "map" }},
+	{"compact", func(m *MatchToken) { m.ExactHostLookup = "compact" }},
+}
+
+func TestHostCaseConsistency(t *testing.T) {
+	for _, lookup := range hostLookups {
+		t.Run(lookup.name, func(t *testing.T) {
+			m := &MatchToken{Prefix: []string{"abc"}, Host: []string{
+				"a.example.com", "API.Example.com", "z.example.com", "{vars.host}",
+			}}
+			lookup.setup(m)
+			provisionMatcher(t, m)
+			repl := caddy.NewReplacer()
+			repl.Set("vars.host", "Tenant.EXAMPLE.com.")
+			for _, tt := range []struct {
+				host string
+				want bool
+			}{
+				{"api.example.com", true},
+				{"API.EXAMPLE.COM", true},
+				{"Api.Example.Com.", true},
+				{"tenant.example.com", true},
+				{"TENANT.example.COM", true},
+				{"other.example.com", false},
+			} {
+				if got := m.matchHost(tt.host, repl); got != tt.want {
+					t.Errorf("matchHost(%q) = %v, want %v", tt.host, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+// hostCase is a request host and whether it is expected to match.
+type hostCase struct {
+	host string
+	want bool
+}
+
+// testHosts checks each host case against a matcher with the given Host
+// entries.
+func testHosts(t *testing.T, entries []string, cases []hostCase) {
+	t.Helper()
+	m := provisionMatcher(t, &MatchToken{Prefix: []string{"abc"}, Host: entries})
+	for _, tt := range cases {
+		if got := m.matchHost(tt.host, nil); got != tt.want {
+			t.Errorf("hosts %q: matchHost(%q) = %v, want %v", entries, tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestWildcardLabels(t *testing.T) {
+	testHosts(t, []string{"*.*.example.com"}, []hostCase{
+		{"a.b.example.com", true},
+		{"a.b.example.com.", true},
+		{"a.example.com", false},
+		{"a.b.c.example.com", false},
+		{".b.example.com", false},
+		{"example.com", false},
+	})
+	testHosts(t, []string{"api.*.example.com", "*.internal.*"}, []hostCase{
+		{"api.eu.example.com", true},
+		{"api.example.com", false},
+		{"web.eu.example.com", false},
+		{"db.internal.lan", true},
+		{"db.internal.lan.", true},
+		{"internal.lan", false},
+	})
+	testHosts(t, []string{"*.example.com.", "**.deep.example.org"}, []hostCase{
+		{"a.example.com", true},
+		{"a.example.com.", true},
+		{"a.b.example.com", false},
+		{"a.deep.example.org", true},
+		{"a.b.deep.example.org.", true},
+		{"deep.example.org", false},
+	})
+}
+
+func TestGlobLabels(t *testing.T) {
+	testHosts(t, []string{"api-?.example.com", "db[0-9].example.com", "x[^a-c].example.com", `lit\?.example.com`}, []hostCase{
+		{"api-1.example.com", true},
+		{"api-x.example.com", true},
+		{"api-.example.com", false},
+		{"api-12.example.com", false},
+		{"db7.example.com", true},
+		{"dbx.example.com", false},
+		{"xd.example.com", true},
+		{"xb.example.com", false},
+		{"lit?.example.com", true},
+		{"lita.example.com", false},
+	})
+	for _, entry := range []string{"db[0-9.example.com", `bad\`} {
+		m := &MatchToken{Prefix: []string{"abc"}, Host: []string{entry}}
+		if err := m.provision(zap.NewNop()); err == nil {
+			t.Errorf("expected an error for host pattern %q", entry)
+		}
+	}
+}
+
+func TestIDNRequestHosts(t *testing.T) {
+	testHosts(t, []string{"münchen.example", "xn--bcher-kva.example"}, []hostCase{
+		{"münchen.example", true},
+		{"MÜNCHEN.example", true},
+		{"xn--mnchen-3ya.example", true},
+		{"bücher.example", true},
+		{"xn--bcher-kva.example", true},
+		{"munchen.example", false},
+	})
+}
+
+func TestIDNWildcardHosts(t *testing.T) {
+	testHosts(t, []string{"*.例え.jp", "**.bücher.de", "api-?.ＥＸＡＭＰＬＥ.org"}, []hostCase{
+		{"a.例え.jp", true},
+		{"a.xn--r8jz45g.jp", true},
+		{"a.b.例え.jp", false},
+		{"x.y.bücher.de", true},
+		{"x.xn--bcher-kva.de", true},
+		{"api-1.ＥＸＡＭＰＬＥ.org", true},
+	})
+	for _, entry := range []string{"例*.jp", "*.例?.jp"} {
+		m := &MatchToken{Prefix: []string{"abc"}, Host: []string{entry}}
+		err := m.provision(zap.NewNop())
+		if err == nil {
+			t.Errorf("expected an error for the non-ASCII glob label of %q", entry)
+			continue
+		}
+		if got := asProvisionError(err).(*ProvisionError).Category(); got != CategoryInvalidHost {
+			t.Errorf("%q: error category %q, want %q", entry, got, CategoryInvalidHost)
+		}
+	}
+}
+
+func TestWildcardHostPorts(t *testing.T) {
+	m := provisionMatcher(t, &MatchToken{
+		Prefix:            []string{"abc"},
+		Host:              []string{"*.example.com:8443", "*.example.com", "api.example.org:8080"},
+		MatchHostWithPort: true,
+	})
+	for _, tt := range []hostCase{
+		{"a.example.com:8443", true},
+		{"a.example.com", true},
+		{"a.example.com:9443", false},
+		{"a.b.example.com:8443", false},
+		{"api.example.org:8080", true},
+		{"api.example.org", false},
+	} {
+		if got := m.matchHost(tt.host, nil); got != tt.want {
+			t.Errorf("matchHost(%q) = %v, want %v", tt.host, got, tt.want)
+		}
+	}
+
+	for _, entry := range []string{"*.example.com:8443", "example.com:8443"} {
+		m := &MatchToken{Prefix: []string{"abc"}, Host: []string{entry}}
+		if err := m.provision(zap.NewNop()); err == nil {
+			t.Errorf("expected an error for %q without match_host_with_port", entry)
+		}
+	}
+	// without match_host_with_port, the port of the request is ignored
+	m = provisionMatcher(t, &MatchToken{Prefix: []string{"abc"}, Host: []string{"*.example.com", "::1"}})
+	for _, host := range []string{"a.example.com:8443", "[::1]:443"} {
+		req := newRequest("http://example.com/", map[string]string{"token": "abc1"})
+		req.Host = host
+		if !m.Match(req) {
+			t.Errorf("Host %q did not match", host)
+		}
+	}
+}
+
+func TestPrefixSeparator(t *testing.T) {
+	for _, constantTime := range []bool{false, true} {
+		m := provisionMatcher(t, &MatchToken{
+			Prefix:                      []string{"v1"},
+			RequireSeparatorAfterPrefix: "_",
+			ConstantTime:                constantTime,
+			Host:                        []string{"example.com"},
+		})
+		for _, tt := range []struct {
+			token string
+			want  bool
+		}{
+			{"v1", true},
+			{"v1_", true},
+			{"v1_abc", true},
+			{"v12", false},
+			{"v1abc", false},
+			{"v", false},
+			{"v2_abc", false},
+		} {
+			req := newRequest("http://example.com/", map[string]string{"token": tt.token})
+			if got := m.Match(req); got != tt.want {
+				t.Errorf("constant_time=%v: Match(%q) = %v, want %v", constantTime, tt.token, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestLargeThreshold(t *testing.T) {
+	hosts := make([]string, 10)
+	for i := range hosts {
+		hosts[i] = fmt.Sprintf("h%d.example.com", i)
+	}
+	hosts = append(hosts, "*.wild.example.com")
+	queries := []string{"h0.example.com", "h9.example.com", "H5.EXAMPLE.COM", "h10.example.com", "example.com", "a.wild.example.com", ""}
+
+	linear := provisionMatcher(t, &MatchToken{Prefix: []string{"abc"}, Host: hosts, LargeThreshold: 1000})
+	for _, threshold := range []int{1, len(hosts) - 2, len(hosts) - 1, len(hosts)} {
+		m := provisionMatcher(t, &MatchToken{Prefix: []string{"abc"}, Host: hosts, LargeThreshold: threshold})
+		for _, host := range queries {
+			if got, want := m.matchHost(host, nil), linear.matchHost(host, nil); got != want {
+				t.Errorf("threshold %d: matchHost(%q) = %v, linear path gives %v", threshold, host, got, want)
+			}
+		}
+	}
+}
+
+func TestExpandHost(t *testing.T) {
+	repl := caddy.NewReplacer()
+	repl.Set("self", "{self}")
+	repl.Set("other", "{self}.example.com")
+	repl.Set("glob", "*")
+	repl.Set("long", strings.Repeat("a", 1<<20))
+	repl.Set("label", strings.Repeat("a", 63))
+	for _, tt := range []struct {
+		tmpl string
+		want string
+		ok   bool
+	}{
+		{"{self}", "{self}", true},
+		{"{other}", "{self}.example.com", true},
+		{"{glob}.example.com", `\*.example.com`, true},
+		{"{long}.example.com", "", false},
+		{"{label}.{label}.{label}.{label}", "", false},
+		{"{label}.{label}.{label}:{label}", "", false},
+	} {
+		got, ok := expandHost(tt.tmpl, repl)
+		if ok != tt.ok || (ok && got != tt.want) {
+			t.Errorf("expandHost(%q) = %q, %v, want %q, %v", tt.tmpl, got, ok, tt.want, tt.ok)
+		}
+		if ok && len(got) > maxExpandedHostLen {
+			t.Errorf("expandHost(%q) returned %d bytes", tt.tmpl, len(got))
+		}
+	}
+
+	allocs := testing.AllocsPerRun(100, func() { expandHost("{long}.{long}.{long}", repl) })
+	if allocs > 10 {
+		t.Errorf("expandHost of an oversized value made %v allocations", allocs)
+	}
+}
+
+func TestAdversarialPlaceholderHosts(t *testing.T) {
+	m := provisionMatcher(t, &MatchToken{
+		Prefix: []string{"abc"},
+		Host:   []string{"{http.request.header.X-Host}", "{http.request.header.X-Sub}.example.com"},
+	})
+	for _, tt := range []struct {
+		name   string
+		host   string
+		header map[string]string
+		want   bool
+	}{
+		{"self reference is literal", "{http.request.header.x-host}", map[string]string{"X-Host": "{http.request.header.X-Host}"}, true},
+		{"nested placeholder", "a.example.com", map[string]string{"X-Host": "{http.request.host}"}, false},
+		{"glob value", "a.example.com", map[string]string{"X-Sub": "*"}, false},
+		{"oversized value", strings.Repeat("a", 300) + ".example.com", map[string]string{"X-Sub": strings.Repeat("a", 300)}, false},
+		{"plain value", "a.example.com", map[string]string{"X-Sub": "a"}, true},
+		{"missing value", "", map[string]string{}, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.header["token"] = "abc1"
+			req := newRequest("http://example.com/", tt.header)
+			req.Host = tt.host
+			// with the request placeholders, unlike newRequest
+			req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddyhttp.NewTestReplacer(req)))
+			if got := m.Match(req); got != tt.want {
+				t.Errorf("Match() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// BenchmarkFuzzyPartitioning compares the partitioned host list with a scan
+// of every entry that tells the fuzzy ones apart and splits them on each
+// request, as was done before. The request host is only matched by the last
+// wildcard.
+func BenchmarkFuzzyPartitioning(b *testing.B) {
+	var hosts []string
+	for i := 0; i < 1000; i++ {
+		hosts = append(hosts, fmt.Sprintf("h%d.example.com", i))
+		if i%20 == 0 {
+			hosts = append(hosts, fmt.Sprintf("api-%d.*.example.com", i))
+		}
+	}
+	const reqHost = "api-980.eu.example.com"
+	m := provisionMatcher(b, &MatchToken{Prefix: []string{"abc"}, Host: hosts})
+
+	b.Run("partitioned", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if !m.matchHost(reqHost, nil) {
+				b.Fatal("no match")
+			}
+		}
+	})
+	b.Run("scan", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			matched := false
+			for _, host := range hosts {
+				if !isGlob(host) {
+					if host == reqHost {
+						matched = true
+						break
+					}
+					continue
+				}
+				parts, port := m.splitIncomingHost(reqHost)
+				if m.matchHostPattern(newHostPattern(host), parts, port) {
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				b.Fatal("no match")
+			}
+		}
+	})
+}
+
+// BenchmarkWildcardHosts compares 500 pre-split wildcard hosts with
+// splitting each pattern on every request.
+func BenchmarkWildcardHosts(b *testing.B) {
+	hosts := make([]string, 500)
+	for i := range hosts {
+		hosts[i] = fmt.Sprintf("api-%d.*.example.com", i)
+	}
+	const reqHost = "api-499.eu.example.com"
+	m := provisionMatcher(b, &MatchToken{Prefix: []string{"abc"}, Host: hosts})
+
+	b.Run("presplit", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if !m.matchHost(reqHost, nil) {
+				b.Fatal("no match")
+			}
+		}
+	})
+	b.Run("split", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			matched := false
+			for _, host := range hosts {
+				parts, port := m.splitIncomingHost(reqHost)
+				if m.matchHostPattern(newHostPattern(host), parts, port) {
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				b.Fatal("no match")
+			}
+		}
+	})
+}
+
+// BenchmarkExactHostLookup compares the map and the binary search across list
+// sizes, for a host in the middle of the list.
+func BenchmarkExactHostLookup(b *testing.B) {
+	for _, size := range []int{10, 100, 1000, 10000, 100000} {
+		hosts := make([]string, size)
+		for i := range hosts {
+			hosts[i] = fmt.Sprintf("h%d.example.com", i)
+		}
+		reqHost := hosts[size/2]
+		for _, lookup := range []string{"binary", "map"} {
+			b.Run(fmt.Sprintf("%s/size=%d", lookup, size), func(b *testing.B) {
+				// with LargeThreshold 1, "binary" never falls back to the linear scan
+				m := provisionMatcher(b, &MatchToken{Prefix: []string{"abc"}, Host: hosts, ExactHostLookup: lookup, LargeThreshold: 1})
+				set := m.hosts()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if !m.hasExactHost(&set.include, reqHost) {
+						b.Fatal("no match")
+					}
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkHostTable compares the latency and the memory held by 100k exact
+// hosts in a hostTable and in a sorted slice with binary search.
+func BenchmarkHostTable(b *testing.B) {
+	hosts := make([]string, 100000)
+	for i := range hosts {
+		hosts[i] = fmt.Sprintf("h%06d.example.com", i)
+	}
+	queries := []string{hosts[0], hosts[len(hosts)/2], hosts[len(hosts)-1], "missing.example.com"}
+
+	// heapBytes returns the heap memory still held by what build returns
+	heapBytes := func(build func() any) (any, int64) {
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		v := build()
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		return v, int64(after.HeapAlloc) - int64(before.HeapAlloc)
+	}
+
+	b.Run("slice", func(b *testing.B) {
+		v, n := heapBytes(func() any {
+			s := make([]string, len(hosts))
+			for i, host := range hosts {
+				s[i] = strings.Clone(host)
+			}
+			return s
+		})
+		s := v.([]string)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			host := queries[i%len(queries)]
+			pos := sort.SearchStrings(s, host)
+			_ = pos < len(s) && s[pos] == host
+		}
+		b.ReportMetric(float64(n), "heap-bytes")
+	})
+	b.Run("compact", func(b *testing.B) {
+		v, n := heapBytes(func() any {
+			t, err := newHostTable(hosts)
+			if err != nil {
+				b.Fatal(err)
+			}
+			return t
+		})
+		t := v.(*hostTable)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			t.contains(queries[i%len(queries)])
+		}
+		b.ReportMetric(float64(n), "heap-bytes")
+	})
+}
+
+// BenchmarkLeftmostWildcard compares the suffix lookup of 1000 "*.<domain>"
+// hosts with matching them label by label, as other wildcards are.
+func BenchmarkLeftmostWildcard(b *testing.B) {
+	hosts := make([]string, 1000)
+	patterns := make([]hostPattern, len(hosts))
+	for i := range hosts {
+		hosts[i] = fmt.Sprintf("*.d%d.example.com", i)
+		patterns[i] = newHostPattern(hosts[i])
+	}
+	const reqHost = "www.d999.example.com"
+	m := provisionMatcher(b, &MatchToken{Prefix: []string{"abc"}, Host: hosts})
+	if n := len(m.hosts().include.leftmost); n != len(hosts) {
+		b.Fatalf("%d leftmost wildcards, want %d", n, len(hosts))
+	}
+
+	b.Run("leftmost", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if !m.matchHost(reqHost, nil) {
+				b.Fatal("no match")
+			}
+		}
+	})
+	b.Run("labels", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			parts, port := m.splitIncomingHost(reqHost)
+			matched := false
+			for _, pattern := range patterns {
+				if m.matchHostPattern(pattern, parts, port) {
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				b.Fatal("no match")
+			}
+		}
+	})
+}
+
+func TestMatchedPrefixPreparedToken(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		m     *MatchToken
+		token string
+	}{
+		{"strip_bearer", &MatchToken{Prefix: []string{"v1_"}, StripBearer: true}, "Bearer v1_abc"},
+		{"decode_base64", &MatchToken{Prefix: []string{"v1_"}, DecodeBase64: true}, "djFfYWJj"},
+		{"both", &MatchToken{Prefix: []string{"v1_"}, StripBearer: true, DecodeBase64: true}, "Bearer djFfYWJj"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.m.Host = []string{"example.com"}
+			m := provisionMatcher(t, tt.m)
+			req := newRequest("http://example.com/", map[string]string{"token": tt.token})
+			req = req.WithContext(context.WithValue(req.Context(), caddyhttp.VarsCtxKey, map[string]any{}))
+			if !m.Match(req) {
+				t.Fatal("request did not match")
+			}
+			if got := caddyhttp.GetVar(req.Context(), matchedPrefixVar); got != "v1_" {
+				t.Errorf("matched prefix = %v, want v1_", got)
+			}
+		})
+	}
+}
+
+func TestRulesIgnoredPrefixWarning(t *testing.T) {
+	for _, tt := range []struct {
+		m    *MatchToken
+		want int
+	}{
+		{&MatchToken{Prefix: []string{"abc"}, Rules: []TokenRule{{Prefix: "r_", Host: []string{"r.example.com"}}}}, 1},
+		{&MatchToken{PrefixTemplate: "{http.request.header.X-Tenant}_", Rules: []TokenRule{{Prefix: "r_", Host: []string{"r.example.com"}}}}, 1},
+		{&MatchToken{Rules: []TokenRule{{Prefix: "r_", Host: []string{"r.example.com"}}}}, 0},
+		{&MatchToken{Prefix: []string{"abc"}, Host: []string{"example.com"}, Rules: []TokenRule{{Prefix: "r_", Host: []string{"r.example.com"}}}}, 0},
+	} {
+		core, logs := observer.New(zap.WarnLevel)
+		if err := tt.m.provision(zap.New(core)); err != nil {
+			t.Fatalf("provisioning: %v", err)
+		}
+		if err := tt.m.Validate(); err != nil {
+			t.Fatalf("validating: %v", err)
+		}
+		if n := logs.FilterMessageSnippet("ignoring tokenprefix").Len(); n != tt.want {
+			t.Errorf("prefix %v, template %q: %d warnings, want %d", tt.m.Prefix, tt.m.PrefixTemplate, n, tt.want)
+		}
+		tt.m.Cleanup()
+	}
+}
+
+func TestWebSocketProtocolToken(t *testing.T) {
+	m := provisionMatcher(t, &MatchToken{
+		Prefix:                  []string{"v1_"},
+		Host:                    []string{"example.com"},
+		ReadWebSocketProtocol:   true,
+		WebSocketProtocolPrefix: "token.",
+	})
+	for _, tt := range []struct {
+		value string
+		want  string
+	}{
+		{"token.v1_abc", "v1_abc"},
+		{"chat, token.v1_abc", "v1_abc"},
+		{"token., token.v1_abc", "v1_abc"},
+		{"token.", ""},
+		{"chat", ""},
+	} {
+		req := newRequest("http://example.com/", map[string]string{"Sec-WebSocket-Protocol": tt.value})
+		if got := m.webSocketProtocolToken(req); got != tt.want {
+			t.Errorf("webSocketProtocolToken(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+	req := newRequest("http://example.com/", map[string]string{"Sec-WebSocket-Protocol": "token., token.v1_abc"})
+	if !m.Match(req) {
+		t.Error("request with an empty token subprotocol first did not match")
+	}
+}
+
+// TestMatchStrings checks the host and token conditions on plain strings,
+// without a request nor a replacer.
+func TestMatchStrings(t *testing.T) {
+	m := provisionMatcher(t, &MatchToken{
+		Prefix: []string{"abc"},
+		Host:   []string{"example.com", "*.example.org", "!bad.example.org", "{http.request.header.X-Host}"},
+	})
+	for _, tt := range []hostCase{
+		{"example.com", true},
+		{"EXAMPLE.com.", true},
+		{"a.example.org", true},
+		{"bad.example.org", false},
+		{"example.net", false},
+	} {
+		if got := m.matchHost(tt.host, nil); got != tt.want {
+			t.Errorf("matchHost(%q, nil) = %v, want %v", tt.host, got, tt.want)
+		}
+	}
+	for _, tt := range []struct {
+		token string
+		want  bool
+	}{
+		{"abc1", true},
+		{"abc", true},
+		{"ab", false},
+		{"", false},
+	} {
+		if _, got, _ := m.acceptToken(tt.token, false, nil); got != tt.want {
+			t.Errorf("acceptToken(%q) = %v, want %v", tt.token, got, tt.want)
+		}
+	}
+}
+
+func TestHostMode(t *testing.T) {
+	for _, mode := range []string{"", "exact", "suffix"} {
+		m := &MatchToken{Prefix: []string{"abc"}, Host: []string{"example.com"}, HostMode: mode}
+		if err := m.provision(zap.NewNop()); err != nil {
+			t.Errorf("host_mode %q: %v", mode, err)
+		}
+	}
+	m := &MatchToken{Prefix: []string{"abc"}, Host: []string{"example.com"}, HostMode: "wildcard"}
+	if err := m.provision(zap.NewNop()); err == nil {
+		t.Error("expected an error for host_mode wildcard")
+	}
+}
+
+func TestUppercasePlaceholderHosts(t *testing.T) {
+	t.Setenv("TENANT_HOST", "Tenant.Example.com")
+	m := provisionMatcher(t, &MatchToken{
+		Prefix: []string{"abc"},
+		Host:   []string{"{env.TENANT_HOST}", "{http.vars.TenantHost}.Example.org"},
+	})
+	repl := caddy.NewReplacer()
+	repl.Set("http.vars.TenantHost", "Other")
+	for _, host := range []string{"tenant.example.com", "other.example.org"} {
+		if !m.matchHost(host, repl) {
+			t.Errorf("matchHost(%q) = false, want true", host)
+		}
+	}
+}
+
+func TestBracketedIPv6Hosts(t *testing.T) {
+	m := provisionMatcher(t, &MatchToken{Prefix: []string{"abc"}, Host: []string{"[::1]:8443", "[::2]"}, MatchHostWithPort: true})
+	for _, tt := range []hostCase{
+		{"[::1]:8443", true},
+		{"1:8443", false},
+		{"[::1]:9443", false},
+		{"[::2]", true},
+	} {
+		if got := m.matchHost(tt.host, nil); got != tt.want {
+			t.Errorf("match_host_with_port: matchHost(%q) = %v, want %v", tt.host, got, tt.want)
+		}
+	}
+
+	m = provisionMatcher(t, &MatchToken{Prefix: []string{"abc"}, Host: []string{"[::1]", "[0-9].example.com"}})
+	for _, host := range []string{"[::1]", "[::1]:443", "5.example.com"} {
+		req := newRequest("http://example.com/", map[string]string{"token": "abc1"})
+		req.Host = host
+		if !m.Match(req) {
+			t.Errorf("Host %q did not match", host)
+		}
+	}
+}
+
+func TestHostPrefixFallback(t *testing.T) {
+	m := provisionMatcher(t, &MatchToken{
+		Prefix:       []string{"g_"},
+		HostPrefixes: []HostPrefix{{Host: "a.example.com", Prefix: "a_"}, {Host: "b.example.com"}},
+	})
+	for _, tt := range []struct {
+		host, token string
+		want        bool
+	}{
+		{"a.example.com", "a_1", true},
+		{"a.example.com", "g_1", false},
+		{"b.example.com", "g_1", true},
+		{"b.example.com", "a_1", false},
+	} {
+		req := newRequest("http://"+tt.host+"/", map[string]string{"token": tt.token})
+		if got := m.Match(req); got != tt.want {
+			t.Errorf("%s with %s: Match() = %v, want %v", tt.host, tt.token, got, tt.want)
+		}
+	}
+
+	m = &MatchToken{HostPrefixes: []HostPrefix{{Host: "b.example.com"}}}
+	if err := m.provision(zap.NewNop()); err == nil {
+		t.Error("expected an error for a host prefix without any prefix")
+	}
+}
+
+func TestHostPrefixExcludedHosts(t *testing.T) {
+	m := provisionMatcher(t, &MatchToken{
+		Prefix:       []string{"g_"},
+		Host:         []string{"example.com", "!admin.example.com"},
+		HostPrefixes: []HostPrefix{{Host: "*.example.com", Prefix: "h_"}},
+	})
+	for _, tt := range []struct {
+		host string
+		want bool
+	}{
+		{"a.example.com", true},
+		{"admin.example.com", false},
+		{"ADMIN.example.com.", false},
+	} {
+		req := newRequest("http://example.com/", map[string]string{"token": "h_1"})
+		req.Host = tt.host
+		if got := m.Match(req); got != tt.want {
+			t.Errorf("Match(%q) = %v, want %v", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestRuleExcludedHosts(t *testing.T) {
+	for _, cacheSize := range []int{0, 10} {
+		m := provisionMatcher(t, &MatchToken{
+			Prefix:            []string{"g_"},
+			Host:              []string{"example.com", "!admin.example.com"},
+			Rules:             []TokenRule{{Prefix: "r_", Host: []string{"*.example.com"}}},
+			DecisionCacheSize: cacheSize,
+		})
+		for _, tt := range []struct {
+			host string
+			want bool
+		}{
+			{"a.example.com", true},
+			{"admin.example.com", false},
+		} {
+			req := newRequest("http://example.com/", map[string]string{"token": "r_1"})
+			req.Host = tt.host
+			if got := m.Match(req); got != tt.want {
+				t.Errorf("decision_cache_size %d: Match(%q) = %v, want %v", cacheSize, tt.host, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestStrictSingleSourceNames(t *testing.T) {
+	m := provisionMatcher(t, &MatchToken{
+		Prefix:             []string{"abc"},
+		Host:               []string{"example.com"},
+		HeaderNames:        []string{"token", "X-Legacy-Token"},
+		CookieNames:        []string{"c1", "c2"},
+		StrictSingleSource: true,
+	})
+	for _, tt := range []struct {
+		name   string
+		header map[string]string
+		want   bool
+	}{
+		{"same headers", map[string]string{"token": "abc1", "X-Legacy-Token": "abc1"}, true},
+		{"different headers", map[string]string{"token": "abc1", "X-Legacy-Token": "abc2"}, false},
+		{"same cookies", map[string]string{"Cookie": "c1=abc1; c2=abc1"}, true},
+		{"different cookies", map[string]string{"Cookie": "c1=abc1; c2=abc2"}, false},
+		{"second header only", map[string]string{"X-Legacy-Token": "abc1"}, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := m.Match(newRequest("http://example.com/", tt.header)); got != tt.want {
+				t.Errorf("Match() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrefixTemplateMissingValue(t *testing.T) {
+	for _, m := range []*MatchToken{
+		{PrefixTemplate: "{http.request.header.X-Tenant}-", Host: []string{"example.com"}},
+		{Prefix: []string{"{http.request.header.X-Tenant}-"}, Host: []string{"example.com"}},
+	} {
+		m := provisionMatcher(t, m)
+		for _, tt := range []struct {
+			header map[string]string
+			want   bool
+		}{
+			{map[string]string{"X-Tenant": "acme", "token": "acme-1"}, true},
+			{map[string]string{"token": "-1"}, false},
+			{map[string]string{"X-Tenant": "", "token": "-1"}, false},
+			{map[string]string{"X-Tenant": "other", "token": "acme-1"}, false},
+		} {
+			req := newRequest("http://example.com/", tt.header)
+			req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddyhttp.NewTestReplacer(req)))
+			if got := m.Match(req); got != tt.want {
+				t.Errorf("template %q %q, headers %v: Match() = %v, want %v", m.PrefixTemplate, m.Prefix, tt.header, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestDecodeBase64Negate(t *testing.T) {
+	m := provisionMatcher(t, &MatchToken{Prefix: []string{"v1_"}, Host: []string{"example.com"}, DecodeBase64: true, Negate: true})
+	for _, tt := range []struct {
+		token string
+		want  bool
+	}{
+		{"djFfYWJj", false}, // "v1_abc"
+		{"djJfYWJj", true},  // "v2_abc"
+		{"not base64!", false},
+	} {
+		if got := m.Match(newRequest("http://example.com/", map[string]string{"token": tt.token})); got != tt.want {
+			t.Errorf("Match(%q) = %v, want %v", tt.token, got, tt.want)
+		}
+	}
+}
+
+func TestFormTokenReadOnce(t *testing.T) {
+	m := provisionMatcher(t, &MatchToken{
+		FormField:          "token",
+		Host:               []string{"a.example.com"},
+		Prefix:             []string{"a_"},
+		Rules:              []TokenRule{{Prefix: "r1_", Host: []string{"b.example.com"}}, {Prefix: "r2_", Host: []string{"b.example.com"}}},
+		StrictSingleSource: true,
+	})
+	const form = "token=r2_abc&other=1"
+	req := httptest.NewRequest(http.MethodPost, "http://b.example.com/", strings.NewReader(form))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+	for i := 0; i < 2; i++ {
+		if !m.Match(req) {
+			t.Fatalf("request %d did not match", i)
+		}
+	}
+	body, ok := req.Body.(*formBody)
+	if !ok {
+		t.Fatalf("body is %T, want *formBody", req.Body)
+	}
+	if _, nested := body.Closer.(*formBody); nested {
+		t.Error("the body was wrapped more than once")
+	}
+	if b, _ := io.ReadAll(req.Body); string(b) != form {
+		t.Errorf("body read downstream = %q, want %q", b, form)
+	}
+}
+
+func TestDecisionCacheOversizedToken(t *testing.T) {
+	m := provisionMatcher(t, &MatchToken{Prefix: []string{"abc"}, Host: []string{"example.com"}, MaxTokenBytes: 16, DecisionCacheSize: 10})
+	req := newRequest("http://example.com/", map[string]string{"token": "abc" + strings.Repeat("x", 32)})
+	if m.Match(req) {
+		t.Error("oversized token matched")
+	}
+	if n := m.decisions.order.Len(); n != 0 {
+		t.Errorf("decision cache has %d entries, want 0", n)
+	}
+}